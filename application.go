@@ -5,6 +5,7 @@
 package libconfd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -101,7 +102,10 @@ func (p *Application) Make(names ...string) {
 }
 
 func (p *Application) GetValues(keys ...string) {
-	m, err := p.client.GetValues(keys)
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.GetBackendTimeout())
+	defer cancel()
+
+	m, err := ToBackendClientV2(p.client).GetValuesContext(ctx, keys)
 	if err != nil {
 		GetLogger().Fatal(err)
 	}
@@ -118,18 +122,67 @@ func (p *Application) GetValues(keys ...string) {
 	}
 }
 
+func (p *Application) SetValues(values map[string]string) {
+	w, err := ToBackendWriter(p.client)
+	if err != nil {
+		GetLogger().Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.GetBackendTimeout())
+	defer cancel()
+
+	if err := w.SetValues(ctx, values); err != nil {
+		GetLogger().Fatal(err)
+	}
+
+	fmt.Println("done")
+}
+
+func (p *Application) DeleteKeys(keys ...string) {
+	if err := ValidDeleteKeys(keys); err != nil {
+		GetLogger().Fatal(err)
+	}
+
+	w, err := ToBackendWriter(p.client)
+	if err != nil {
+		GetLogger().Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.GetBackendTimeout())
+	defer cancel()
+
+	if err := w.DeleteKeys(ctx, keys); err != nil {
+		GetLogger().Fatal(err)
+	}
+
+	fmt.Println("done")
+}
+
 func (p *Application) Run(opts ...Options) {
+	p.RunContext(context.Background(), opts...)
+}
+
+// RunContext runs the processor until ctx is done or an interrupt signal
+// is received.
+func (p *Application) RunContext(ctx context.Context, opts ...Options) {
 	service := NewProcessor()
+	defer service.Close()
 
-	go func() {
-		defer service.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill)
-		<-c
+		defer signal.Stop(c)
 
-		fmt.Println("quit")
+		select {
+		case <-c:
+			fmt.Println("quit")
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 
-	service.Run(p.cfg, p.client, opts...)
+	service.RunContext(ctx, p.cfg, p.client, opts...)
 }
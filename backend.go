@@ -5,8 +5,14 @@
 package libconfd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -22,15 +28,123 @@ type BackendConfig struct {
 	ClientCert   string `toml:"client_cert" json:"client_cert"`
 	ClientKey    string `toml:"client_key" json:"client_key"`
 
+	// backend specific options, see the backend type for supported names
+	Options map[string]string `toml:"options" json:"options"`
+
+	// child backends of the composite backend, see CompositeBackend
+	Backends []*BackendConfig `toml:"backends" json:"backends"`
+
 	HookKeyAdjuster func(key string) (realKey string) `toml:"-" json:"-"`
 }
 
 func (p *BackendConfig) Clone() *BackendConfig {
 	var q = *p
 	q.Host = append([]string{}, p.Host...)
+
+	// clone map
+	if p.Options != nil {
+		q.Options = make(map[string]string)
+		for k, v := range p.Options {
+			q.Options[k] = v
+		}
+	}
+
+	// clone child backends
+	if p.Backends != nil {
+		q.Backends = make([]*BackendConfig, len(p.Backends))
+		for i, child := range p.Backends {
+			q.Backends[i] = child.Clone()
+		}
+	}
+
 	return &q
 }
 
+// TLSConfig returns the TLS config from ClientCAKeys, ClientCert and ClientKey.
+// It returns nil if none of them is set.
+func (p *BackendConfig) TLSConfig() (*tls.Config, error) {
+	if p.ClientCAKeys == "" && p.ClientCert == "" && p.ClientKey == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: false,
+	}
+
+	if p.ClientCAKeys != "" {
+		certBytes, err := ioutil.ReadFile(p.ClientCAKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(certBytes) {
+			return nil, fmt.Errorf("libconfd: no certificate found in %s", p.ClientCAKeys)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if p.ClientCert != "" && p.ClientKey != "" {
+		tlsCert, err := tls.LoadX509KeyPair(p.ClientCert, p.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{tlsCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// GetOption returns the named backend option, or defaultValue if not set.
+func (p *BackendConfig) GetOption(name, defaultValue string) string {
+	if v, ok := p.Options[name]; ok {
+		return v
+	}
+	return defaultValue
+}
+
+// GetIntOption returns the named backend option parsed by strconv.Atoi,
+// or defaultValue if not set.
+func (p *BackendConfig) GetIntOption(name string, defaultValue int) (int, error) {
+	v, ok := p.Options[name]
+	if !ok || v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("libconfd: invalid option %s = %q: %v", name, v, err)
+	}
+	return n, nil
+}
+
+// GetBoolOption returns the named backend option parsed by strconv.ParseBool,
+// or defaultValue if not set.
+func (p *BackendConfig) GetBoolOption(name string, defaultValue bool) (bool, error) {
+	v, ok := p.Options[name]
+	if !ok || v == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("libconfd: invalid option %s = %q: %v", name, v, err)
+	}
+	return b, nil
+}
+
+// GetDurationOption returns the named backend option parsed by time.ParseDuration,
+// or defaultValue if not set.
+func (p *BackendConfig) GetDurationOption(name string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := p.Options[name]
+	if !ok || v == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("libconfd: invalid option %s = %q: %v", name, v, err)
+	}
+	return d, nil
+}
+
 type BackendClient interface {
 	Type() string
 	GetValues(keys []string) (map[string]string, error)
@@ -39,6 +153,160 @@ type BackendClient interface {
 	Close() error
 }
 
+// BackendClientV2 is the context-aware version of BackendClient.
+//
+// GetValuesContext and Watch return ctx.Err() when ctx is done, so the
+// caller can stop them with a deadline or a cancel. Use ToBackendClientV2
+// to get a BackendClientV2 from any BackendClient.
+type BackendClientV2 interface {
+	Type() string
+	GetValuesContext(ctx context.Context, keys []string) (map[string]string, error)
+	Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error)
+	WatchEnabled() bool
+	Close() error
+}
+
+// SnapshotReader is an optional interface of BackendClient, which reads
+// the values of keys at the same revision.
+//
+// The Processor uses it instead of GetValuesContext, so a template is
+// rendered from a consistent snapshot, and the revision is available
+// to the template with the revision function and to the hooks.
+type SnapshotReader interface {
+	GetSnapshot(ctx context.Context, keys []string) (values map[string]string, revision uint64, err error)
+}
+
+// ToBackendClientV2 returns client if it implements BackendClientV2,
+// otherwise it returns an adapter calling GetValues and WatchPrefix in
+// a new goroutine, which returns when ctx is done without waiting for
+// GetValues to return.
+//
+// The legacy GetValues can not be interrupted, so its goroutine keeps
+// running until GetValues returns, it is bounded only by the timeouts of
+// the backend itself. WatchPrefix is stopped by closing its stopChan.
+func ToBackendClientV2(client BackendClient) BackendClientV2 {
+	if p, ok := client.(BackendClientV2); ok {
+		return p
+	}
+	return backendClientV2Adapter{client}
+}
+
+type backendClientV2Adapter struct {
+	BackendClient
+}
+
+func (p backendClientV2Adapter) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		m   map[string]string
+		err error
+	}
+
+	// the goroutine exits when GetValues returns, the buffered channel
+	// never blocks it after the caller is gone
+	ch := make(chan result, 1)
+	go func() {
+		m, err := p.GetValues(keys)
+		ch <- result{m, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.m, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p backendClientV2Adapter) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return waitIndex, err
+	}
+
+	type result struct {
+		index uint64
+		err   error
+	}
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	ch := make(chan result, 1)
+	go func() {
+		index, err := p.WatchPrefix(prefix, keys, waitIndex, stopChan)
+		ch <- result{index, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.index, r.err
+	case <-ctx.Done():
+		return waitIndex, ctx.Err()
+	}
+}
+
+// BackendWrapper is implemented by the backends wrapping another backend,
+// such as CachedBackend. A wrapper implements the optional interfaces,
+// such as EventWatcher, by forwarding them to the wrapped backend, and
+// they are used only if the wrapped backend implements them too.
+type BackendWrapper interface {
+	Unwrap() BackendClient
+}
+
+// backendImplements reports whether client and all the backends wrapped
+// by it pass has.
+func backendImplements(client BackendClient, has func(client BackendClient) bool) bool {
+	for {
+		if !has(client) {
+			return false
+		}
+		w, ok := client.(BackendWrapper)
+		if !ok {
+			return true
+		}
+		client = w.Unwrap()
+	}
+}
+
+// toSnapshotReader returns the SnapshotReader of client, which may be
+// wrapped by ToBackendClientV2.
+func toSnapshotReader(client BackendClientV2) (SnapshotReader, bool) {
+	var c BackendClient
+	if p, ok := client.(backendClientV2Adapter); ok {
+		c = p.BackendClient
+	} else if c, ok = client.(BackendClient); !ok {
+		r, ok := client.(SnapshotReader)
+		return r, ok
+	}
+
+	r, ok := c.(SnapshotReader)
+	return r, ok && backendImplements(c, func(c BackendClient) bool {
+		_, ok := c.(SnapshotReader)
+		return ok
+	})
+}
+
+// toEventWatcher returns the EventWatcher of client, see BackendWrapper.
+func toEventWatcher(client BackendClient) (EventWatcher, bool) {
+	w, ok := client.(EventWatcher)
+	return w, ok && backendImplements(client, func(c BackendClient) bool {
+		_, ok := c.(EventWatcher)
+		return ok
+	})
+}
+
+// toKeyAdjuster returns the KeyAdjuster of client, see BackendWrapper.
+func toKeyAdjuster(client BackendClient) (KeyAdjuster, bool) {
+	a, ok := client.(KeyAdjuster)
+	return a, ok && backendImplements(client, func(c BackendClient) bool {
+		_, ok := c.(KeyAdjuster)
+		return ok
+	})
+}
+
 func MustNewBackendClient(cfg *BackendConfig, opts ...func(*BackendConfig)) BackendClient {
 	p, err := NewBackendClient(cfg, opts...)
 	if err != nil {
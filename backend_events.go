@@ -0,0 +1,101 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+type EventType int
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "PUT"
+	case EventDelete:
+		return "DELETE"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is the change of a key.
+type Event struct {
+	Type     EventType
+	Key      string
+	OldValue string // empty if the key is new
+	NewValue string // empty if deleted
+	Revision uint64 // revision of the change
+}
+
+func (p Event) String() string {
+	return fmt.Sprintf("Event{%v %q: %q => %q @%d}", p.Type, p.Key, p.OldValue, p.NewValue, p.Revision)
+}
+
+// EventBatch is a batch of events sent by EventWatcher.
+type EventBatch struct {
+	Events []Event
+
+	// revision after the events, used to resume the watch
+	Revision uint64
+
+	// Events is a snapshot of all keys with EventPut type,
+	// the keys not in Events are deleted.
+	Reset bool
+
+	// the watch is broken, it is the last batch.
+	Err error
+}
+
+// EventWatcher is an optional interface of BackendClient, which streams
+// the change events of keys. The Processor uses it instead of WatchPrefix
+// in watch mode, and renders only when the watched keys are changed.
+type EventWatcher interface {
+	// WatchEvents sends the events of keys under keys after revision to
+	// the returned channel, which is closed when ctx is done or after
+	// a batch with Err.
+	//
+	// If revision is 0 or the events after revision are unavailable,
+	// the first batch is a Reset batch.
+	WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error)
+}
+
+// KeyAdjuster is an optional interface of EventWatcher, which returns the
+// key used by the backend, see BackendConfig.HookKeyAdjuster. The events
+// are sent with the adjusted keys, so the Processor filters them with
+// the adjusted keys of the templates.
+type KeyAdjuster interface {
+	AdjustKey(key string) (realKey string)
+}
+
+// diffEvents returns the events from old to new values, sorted by key.
+func diffEvents(oldValues, newValues map[string]string, revision uint64) []Event {
+	var events []Event
+	for k, v := range newValues {
+		if old, ok := oldValues[k]; !ok || old != v {
+			events = append(events, Event{
+				Type: EventPut, Key: k, OldValue: old, NewValue: v, Revision: revision,
+			})
+		}
+	}
+	for k, old := range oldValues {
+		if _, ok := newValues[k]; !ok {
+			events = append(events, Event{
+				Type: EventDelete, Key: k, OldValue: old, Revision: revision,
+			})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HealthChecker is an optional interface of BackendClient, which checks
+// the backend with a cheap request. The Processor reads the key "/" if
+// the backend does not implement it.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// HealthState is the state of the backend of a Call.
+type HealthState int
+
+const (
+	HealthUnknown  HealthState = iota // not checked yet
+	HealthHealthy                     // the last check succeeded
+	HealthDegraded                    // the last checks failed
+	HealthDown                        // healthDownFailures checks failed
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthHealthy:
+		return "healthy"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// consecutive failed checks before the backend is down
+const healthDownFailures = 3
+
+// the backoff of the failed checks, doubled on each failure
+var (
+	healthMinBackoff = time.Second
+	healthMaxBackoff = 5 * time.Minute
+)
+
+// checkBackendHealth checks client with HealthCheck, or reads "/".
+func checkBackendHealth(ctx context.Context, client BackendClient) error {
+	if p, ok := client.(HealthChecker); ok {
+		return p.HealthCheck(ctx)
+	}
+	_, err := ToBackendClientV2(client).GetValuesContext(ctx, []string{"/"})
+	return err
+}
+
+// healthMonitor is the health state of a Call.
+type healthMonitor struct {
+	mu       sync.Mutex
+	state    HealthState
+	err      error
+	failures int
+	changed  chan struct{} // closed when the state is changed
+}
+
+// get returns the state, the last error, and a channel closed when the
+// state is changed.
+func (p *healthMonitor) get() (HealthState, error, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.state, p.err, p.changed
+}
+
+// update updates the state with the result of a check, and reports
+// whether the state is changed.
+func (p *healthMonitor) update(err error) (HealthState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := HealthHealthy
+	if err == nil {
+		p.failures = 0
+	} else {
+		p.failures++
+		state = HealthDegraded
+		if p.failures >= healthDownFailures {
+			state = HealthDown
+		}
+	}
+	p.err = err
+
+	if state == p.state {
+		return state, false
+	}
+
+	p.state = state
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+	return state, true
+}
+
+// nextCheck returns the delay of the next check, interval if the last
+// check succeeded, otherwise the backoff of the failures.
+func (p *healthMonitor) nextCheck(interval time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failures == 0 {
+		return interval
+	}
+
+	backoff := healthMinBackoff
+	for i := 1; i < p.failures && backoff < healthMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > healthMaxBackoff {
+		backoff = healthMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	var p healthMonitor
+
+	state, err, changed := p.get()
+	tAssert(t, state == HealthUnknown && err == nil, state, err)
+
+	state, ok := p.update(nil)
+	tAssert(t, state == HealthHealthy && ok, state)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed is not closed")
+	}
+	tAssert(t, p.nextCheck(time.Minute) == time.Minute)
+
+	errDown := errors.New("down")
+	for i, expect := range []HealthState{HealthDegraded, HealthDegraded, HealthDown, HealthDown} {
+		state, _ = p.update(errDown)
+		tAssertf(t, state == expect, "%d: state = %v, expect = %v", i, state, expect)
+	}
+	tAssert(t, p.nextCheck(time.Minute) == 8*healthMinBackoff, p.nextCheck(time.Minute))
+
+	p.failures = 100
+	tAssert(t, p.nextCheck(time.Minute) == healthMaxBackoff, p.nextCheck(time.Minute))
+
+	state, ok = p.update(nil)
+	tAssert(t, state == HealthHealthy && ok, state)
+	tAssert(t, HealthDown.String() == "down")
+}
+
+// tHealthBackend fails the health checks and GetValues if err is set.
+type tHealthBackend struct {
+	mu    sync.Mutex
+	err   error
+	calls int
+}
+
+func (p *tHealthBackend) Type() string       { return "libconfd-backend-health" }
+func (p *tHealthBackend) WatchEnabled() bool { return false }
+func (p *tHealthBackend) Close() error       { return nil }
+
+func (p *tHealthBackend) SetError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func (p *tHealthBackend) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func (p *tHealthBackend) HealthCheck(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *tHealthBackend) GetValues(keys []string) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls++
+	return map[string]string{"/a": "1"}, p.err
+}
+
+func (p *tHealthBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return waitIndex, nil
+}
+
+func TestProcessor_health(t *testing.T) {
+	defer func(d time.Duration) { healthMinBackoff = d }(healthMinBackoff)
+	healthMinBackoff = time.Millisecond * 10
+
+	cfg := tMakeConfDir(t, `{{getv "/a"}}`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backend := &tHealthBackend{err: errors.New("backend is down")}
+	states := make(chan HealthState, 10)
+
+	p := NewProcessor()
+	defer p.Close()
+
+	call := p.Go(cfg, backend, WithIntervalMode(), WithInterval(1),
+		WithHookOnHealthChange(func(state HealthState, err error) {
+			states <- state
+		}),
+	)
+
+	expectState := func(expect HealthState) {
+		t.Helper()
+		select {
+		case state := <-states:
+			tAssertf(t, state == expect, "state = %v, expect = %v", state, expect)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout, expect = %v", expect)
+		}
+	}
+
+	expectState(HealthDegraded)
+	expectState(HealthDown)
+
+	// no backend requests while down
+	calls := backend.Calls()
+	time.Sleep(time.Second * 3 / 2)
+	tAssert(t, backend.Calls() == calls, backend.Calls(), calls)
+
+	backend.SetError(nil)
+	expectState(HealthHealthy)
+
+	state, err := call.HealthState()
+	tAssert(t, state == HealthHealthy && err == nil, state, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.Calls() == calls {
+		tAssert(t, time.Now().Before(deadline), "templates are not processed")
+		time.Sleep(time.Second / 10)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// tBlockingBackend blocks GetValues until release is closed,
+// and WatchPrefix until stopChan is closed.
+type tBlockingBackend struct {
+	release chan struct{}
+	stopped chan struct{}
+}
+
+func tNewBlockingBackend() *tBlockingBackend {
+	return &tBlockingBackend{
+		release: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (p *tBlockingBackend) Type() string       { return "libconfd-backend-blocking" }
+func (p *tBlockingBackend) WatchEnabled() bool { return true }
+func (p *tBlockingBackend) Close() error       { return nil }
+
+func (p *tBlockingBackend) GetValues(keys []string) (map[string]string, error) {
+	<-p.release
+	return map[string]string{}, nil
+}
+
+func (p *tBlockingBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	<-stopChan
+	close(p.stopped)
+	return waitIndex, nil
+}
+
+func TestToBackendClientV2(t *testing.T) {
+	backend := tNewBlockingBackend()
+	defer close(backend.release)
+
+	c := ToBackendClientV2(backend)
+
+	// deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+
+	_, err := c.GetValuesContext(ctx, []string{"/"})
+	tAssert(t, err == context.DeadlineExceeded, err)
+
+	// cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Second/10, cancel)
+
+	index, err := c.Watch(ctx, "/", nil, 1)
+	tAssert(t, err == context.Canceled, err)
+	tAssert(t, index == 1, index)
+
+	select {
+	case <-backend.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPrefix is not stopped")
+	}
+}
+
+func TestValidDeleteKeys(t *testing.T) {
+	tAssert(t, ValidDeleteKeys([]string{"/db", "/key/"}) == nil)
+
+	for _, keys := range [][]string{
+		nil,
+		{"/"},
+		{"//"},
+		{"/db/.."},
+		{""},
+		{"db"},
+		{"/db", "/"},
+	} {
+		tAssertf(t, ValidDeleteKeys(keys) != nil, "keys = %q", keys)
+	}
+}
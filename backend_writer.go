@@ -0,0 +1,78 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrCompareFailed is returned by BackendCASWriter if the index of the
+// key is not the expected one.
+var ErrCompareFailed = errors.New("libconfd: compare failed")
+
+// BackendWriter is an optional interface of BackendClient, which changes
+// the values of the backend.
+type BackendWriter interface {
+	// SetValues sets the values of keys, in a single transaction if
+	// the backend supports it.
+	SetValues(ctx context.Context, values map[string]string) error
+
+	// DeleteKeys deletes the keys and the keys under them.
+	DeleteKeys(ctx context.Context, keys []string) error
+}
+
+// BackendCASWriter is an optional interface of BackendClient, which
+// changes a key only if it is not changed since the given index.
+type BackendCASWriter interface {
+	BackendWriter
+
+	// GetIndex returns the value of key and the index of its last change,
+	// the index is 0 if the key does not exist.
+	GetIndex(ctx context.Context, key string) (value string, index uint64, err error)
+
+	// CompareAndSwap sets key to value if the index of key is prevIndex,
+	// prevIndex 0 means the key must not exist. It returns the new index,
+	// or ErrCompareFailed if the index is not matched.
+	CompareAndSwap(ctx context.Context, key, value string, prevIndex uint64) (index uint64, err error)
+
+	// CompareAndDelete deletes key if the index of key is prevIndex.
+	// It returns ErrCompareFailed if the index is not matched.
+	CompareAndDelete(ctx context.Context, key string, prevIndex uint64) error
+}
+
+// ToBackendWriter returns the BackendWriter of client, or an error if
+// client is read-only, see BackendWrapper.
+func ToBackendWriter(client BackendClient) (BackendWriter, error) {
+	p, ok := client.(BackendWriter)
+	if ok && backendImplements(client, func(c BackendClient) bool {
+		_, ok := c.(BackendWriter)
+		return ok
+	}) {
+		return p, nil
+	}
+	return nil, fmt.Errorf("libconfd: backend %s is read-only", client.Type())
+}
+
+// ValidDeleteKeys checks the keys of BackendWriter.DeleteKeys, the keys
+// must be absolute and not the root, since deleting the root or an empty
+// key deletes everything in the backend.
+func ValidDeleteKeys(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("libconfd: no keys to delete")
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "/") {
+			return fmt.Errorf("libconfd: invalid key path %q to delete", key)
+		}
+		if path.Clean(key) == "/" {
+			return fmt.Errorf("libconfd: refuse to delete the root key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const CachedBackendType = "libconfd-backend-cache"
+
+// the timeout of the shared backend requests, same as Config.BackendTimeout
+const defaultCacheTimeout = 30 * time.Second
+
+var (
+	_ BackendClient   = (*CachedBackend)(nil)
+	_ BackendClientV2 = (*CachedBackend)(nil)
+	_ HealthChecker   = (*CachedBackend)(nil)
+	_ BackendWrapper  = (*CachedBackend)(nil)
+	_ SnapshotReader  = (*CachedBackend)(nil)
+	_ EventWatcher    = (*CachedBackend)(nil)
+	_ BackendWriter   = (*CachedBackend)(nil)
+	_ KeyAdjuster     = (*CachedBackend)(nil)
+)
+
+// CachedBackend caches the values of another backend.
+//
+// The values of the same keys are cached for TTL, concurrent requests of
+// the same keys share one backend request. The keys are compared as a
+// set, so the requests of different keys are not shared even if they
+// overlap. If the backend fails, the last values are returned if they are
+// not older than MaxStale, the older entries are dropped. The cached
+// values of the watched keys are dropped when WatchPrefix returns a new
+// index, or WatchEvents sends a batch, so the changes are read at once.
+//
+// The optional interfaces of the backend are forwarded, see BackendWrapper.
+// GetSnapshot is not cached, since the values must be of one revision.
+// SetValues and DeleteKeys drop the cached values of their keys.
+//
+// The shared backend request is not bound to the context of any caller,
+// it times out after Timeout, and each caller stops waiting when its own
+// context is done.
+//
+// Example of confd-backend.toml:
+//
+//	type = "libconfd-backend-cache"
+//
+//	[options]
+//	ttl = "1s"
+//	max_stale = "5m"                        # 0 disables stale values
+//	request_timeout = "30s"                 # 0 disables the timeout
+//
+//	[[backends]]
+//	type = "libconfd-backend-etcdv3"
+//	host = ["127.0.0.1:2379"]
+type CachedBackend struct {
+	Backend  BackendClient
+	TTL      time.Duration
+	MaxStale time.Duration
+	Timeout  time.Duration // of the shared backend requests
+
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry // keys => entry
+	lastEvict time.Time
+
+	hits      uint64 // atomic
+	misses    uint64 // atomic
+	staleHits uint64 // atomic
+	errors    uint64 // atomic
+}
+
+// CacheStats is the counters of CachedBackend.
+type CacheStats struct {
+	Hits      uint64 // served from the cache, include shared requests
+	Misses    uint64 // sent to the backend
+	StaleHits uint64 // served from expired values after an error
+	Errors    uint64 // failed backend requests
+}
+
+type cacheEntry struct {
+	keys    []string
+	values  map[string]string
+	updated time.Time // zero if never succeeded
+	expired bool      // invalidated by watch
+	gen     uint64    // increased by invalidation
+
+	// in-flight request, closed when done
+	done chan struct{}
+	err  error
+}
+
+func init() {
+	RegisterBackendClient(
+		CachedBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewCachedBackendClient(cfg)
+		},
+	)
+}
+
+// NewCachedBackendClient creates the backend of cfg.Backends, the
+// HookKeyAdjuster of cfg is used if not set by the child.
+func NewCachedBackendClient(cfg *BackendConfig) (*CachedBackend, error) {
+	if len(cfg.Backends) != 1 {
+		return nil, fmt.Errorf("libconfd: cache backend requires one backend")
+	}
+
+	ttl, err := cfg.GetDurationOption("ttl", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxStale, err := cfg.GetDurationOption("max_stale", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cfg.GetDurationOption("request_timeout", defaultCacheTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 || maxStale < 0 || timeout < 0 {
+		return nil, fmt.Errorf("libconfd: invalid cache backend ttl/max_stale/request_timeout")
+	}
+
+	client, err := NewBackendClient(cfg.Backends[0], func(c *BackendConfig) {
+		if c.HookKeyAdjuster == nil {
+			c.HookKeyAdjuster = cfg.HookKeyAdjuster
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewCachedBackend(client, ttl, maxStale)
+	c.Timeout = timeout
+	return c, nil
+}
+
+// NewCachedBackend returns a CachedBackend of client, the Timeout is
+// defaultCacheTimeout.
+func NewCachedBackend(client BackendClient, ttl, maxStale time.Duration) *CachedBackend {
+	return &CachedBackend{
+		Backend:  client,
+		TTL:      ttl,
+		MaxStale: maxStale,
+		Timeout:  defaultCacheTimeout,
+		entries:  make(map[string]*cacheEntry),
+	}
+}
+
+func (_ *CachedBackend) Type() string {
+	return CachedBackendType
+}
+
+func (p *CachedBackend) WatchEnabled() bool {
+	return p.Backend.WatchEnabled()
+}
+
+func (p *CachedBackend) Close() error {
+	return p.Backend.Close()
+}
+
+// Unwrap returns the backend, see BackendWrapper.
+func (p *CachedBackend) Unwrap() BackendClient {
+	return p.Backend
+}
+
+// HealthCheck checks the backend, the cache is not used.
+func (p *CachedBackend) HealthCheck(ctx context.Context) error {
+	return checkBackendHealth(ctx, p.Backend)
+}
+
+// Stats returns the counters of the cache.
+func (p *CachedBackend) Stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&p.hits),
+		Misses:    atomic.LoadUint64(&p.misses),
+		StaleHits: atomic.LoadUint64(&p.staleHits),
+		Errors:    atomic.LoadUint64(&p.errors),
+	}
+}
+
+// Invalidate drops the cached values of all keys.
+func (p *CachedBackend) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, e := range p.entries {
+		e.expire()
+	}
+}
+
+func (p *CachedBackend) GetValues(keys []string) (map[string]string, error) {
+	return p.GetValuesContext(context.Background(), keys)
+}
+
+// GetValuesContext returns the cached values of keys, or reads them from
+// the backend if they are expired.
+func (p *CachedBackend) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	cacheKey := strings.Join(keys, "\x00")
+
+	p.mu.Lock()
+	p.evictLocked()
+
+	e, ok := p.entries[cacheKey]
+	if !ok {
+		e = &cacheEntry{keys: keys}
+		p.entries[cacheKey] = e
+	}
+
+	if !e.expired && !e.updated.IsZero() && time.Since(e.updated) < p.TTL {
+		values := copyValues(e.values)
+		p.mu.Unlock()
+
+		atomic.AddUint64(&p.hits, 1)
+		return values, nil
+	}
+
+	done := e.done
+	if done == nil {
+		done = make(chan struct{})
+		e.done = done
+		go p.fetch(e, e.gen, done)
+
+		atomic.AddUint64(&p.misses, 1)
+	} else {
+		atomic.AddUint64(&p.hits, 1)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e.err == nil {
+		return copyValues(e.values), nil
+	}
+
+	if p.MaxStale > 0 && !e.updated.IsZero() && time.Since(e.updated) < p.MaxStale {
+		atomic.AddUint64(&p.staleHits, 1)
+		GetLogger().Warningf("libconfd: %s: %v, use the values of %v ago",
+			p.Backend.Type(), e.err, time.Since(e.updated).Round(time.Second),
+		)
+		return copyValues(e.values), nil
+	}
+	return nil, e.err
+}
+
+// evictLocked drops the entries which can not be used even as stale
+// values, at most once per TTL. The caller must hold p.mu.
+func (p *CachedBackend) evictLocked() {
+	now := time.Now()
+	if now.Sub(p.lastEvict) < p.TTL {
+		return
+	}
+	p.lastEvict = now
+
+	for cacheKey, e := range p.entries {
+		if e.done != nil {
+			continue // in-flight
+		}
+		if e.updated.IsZero() || now.Sub(e.updated) >= p.TTL+p.MaxStale {
+			delete(p.entries, cacheKey)
+		}
+	}
+}
+
+// fetch reads the values of e from the backend, and closes done.
+// The request is shared by the callers, so it is bound to Timeout
+// instead of the context of any caller.
+//
+// If e is invalidated during the request, it is still expired, since the
+// values may be read before the change.
+func (p *CachedBackend) fetch(e *cacheEntry, gen uint64, done chan struct{}) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if p.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+	}
+	defer cancel()
+
+	values, err := ToBackendClientV2(p.Backend).GetValuesContext(ctx, e.keys)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		atomic.AddUint64(&p.errors, 1)
+	} else {
+		e.values = values
+		e.updated = time.Now()
+		e.expired = e.gen != gen
+	}
+	e.err = err
+	e.done = nil
+	close(done)
+}
+
+// WatchPrefix watches the backend, the cached values of keys are dropped
+// if the index is changed.
+func (p *CachedBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	index, err := p.Backend.WatchPrefix(prefix, keys, waitIndex, stopChan)
+	if err == nil && index != waitIndex {
+		if len(keys) == 0 {
+			keys = []string{prefix}
+		}
+		p.invalidateKeys(keys)
+	}
+	return index, err
+}
+
+// Watch watches the backend, the cached values of keys are dropped
+// if the index is changed.
+func (p *CachedBackend) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	index, err := ToBackendClientV2(p.Backend).Watch(ctx, prefix, keys, waitIndex)
+	if err == nil && index != waitIndex {
+		if len(keys) == 0 {
+			keys = []string{prefix}
+		}
+		p.invalidateKeys(keys)
+	}
+	return index, err
+}
+
+// GetSnapshot reads the snapshot from the backend, it is not cached.
+func (p *CachedBackend) GetSnapshot(ctx context.Context, keys []string) (map[string]string, uint64, error) {
+	r, ok := p.Backend.(SnapshotReader)
+	if !ok {
+		return nil, 0, fmt.Errorf("libconfd: backend %s does not support snapshots", p.Backend.Type())
+	}
+	return r.GetSnapshot(ctx, keys)
+}
+
+// WatchEvents watches the events of the backend, the cached values of
+// keys are dropped on every batch.
+func (p *CachedBackend) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error) {
+	w, ok := p.Backend.(EventWatcher)
+	if !ok {
+		return nil, fmt.Errorf("libconfd: backend %s does not support events", p.Backend.Type())
+	}
+
+	ch, err := w.WatchEvents(ctx, prefix, keys, revision)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	out := make(chan EventBatch)
+	go func() {
+		defer close(out)
+		for batch := range ch {
+			p.invalidateKeys(keys)
+
+			select {
+			case out <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// SetValues sets the values in the backend, and drops the cached values
+// of the keys.
+func (p *CachedBackend) SetValues(ctx context.Context, values map[string]string) error {
+	w, err := ToBackendWriter(p.Backend)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	defer p.invalidateKeys(keys)
+
+	return w.SetValues(ctx, values)
+}
+
+// DeleteKeys deletes the keys in the backend, and drops the cached values
+// of the keys.
+func (p *CachedBackend) DeleteKeys(ctx context.Context, keys []string) error {
+	w, err := ToBackendWriter(p.Backend)
+	if err != nil {
+		return err
+	}
+	defer p.invalidateKeys(keys)
+
+	return w.DeleteKeys(ctx, keys)
+}
+
+// AdjustKey returns the key adjusted by the backend, see KeyAdjuster.
+func (p *CachedBackend) AdjustKey(key string) string {
+	if a, ok := p.Backend.(KeyAdjuster); ok {
+		return a.AdjustKey(key)
+	}
+	return key
+}
+
+// invalidateKeys drops the cached values which overlap with keys.
+func (p *CachedBackend) invalidateKeys(keys []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, e := range p.entries {
+	Loop:
+		for _, a := range e.keys {
+			for _, b := range keys {
+				if keysOverlap(a, b) {
+					e.expire()
+					break Loop
+				}
+			}
+		}
+	}
+}
+
+func (e *cacheEntry) expire() {
+	e.expired = true
+	e.gen++
+}
+
+// keysOverlap reports whether a key may be under both prefixes. The
+// prefixes are compared as strings, since some backends do not match
+// them by path.
+func keysOverlap(a, b string) bool {
+	a, b = strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/")
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+func copyValues(m map[string]string) map[string]string {
+	values := make(map[string]string, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+	return values
+}
@@ -0,0 +1,271 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tCountingBackend counts the GetValues calls, the calls block until
+// release is closed if it is not nil.
+type tCountingBackend struct {
+	mu      sync.Mutex
+	values  map[string]string
+	err     error
+	calls   int
+	release chan struct{}
+	index   uint64
+}
+
+func (p *tCountingBackend) Type() string       { return "libconfd-backend-counting" }
+func (p *tCountingBackend) WatchEnabled() bool { return true }
+func (p *tCountingBackend) Close() error       { return nil }
+
+func (p *tCountingBackend) GetValues(keys []string) (map[string]string, error) {
+	p.mu.Lock()
+	p.calls++
+	release := p.release
+	p.mu.Unlock()
+
+	if release != nil {
+		<-release
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	m := make(map[string]string)
+	for k, v := range p.values {
+		m[k] = v
+	}
+	return m, nil
+}
+
+func (p *tCountingBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.index++
+	return p.index, nil
+}
+
+func (p *tCountingBackend) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func TestCachedBackend(t *testing.T) {
+	backend := &tCountingBackend{values: map[string]string{"/key": "foobar"}}
+	c := NewCachedBackend(backend, time.Hour, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		m, err := c.GetValues([]string{"/key"})
+		tAssert(t, err == nil, err)
+		tAssert(t, reflect.DeepEqual(m, map[string]string{"/key": "foobar"}), m)
+	}
+	tAssert(t, backend.Calls() == 1, backend.Calls())
+	tAssert(t, c.Stats() == CacheStats{Hits: 2, Misses: 1}, c.Stats())
+
+	// other keys
+	_, err := c.GetValues([]string{"/"})
+	tAssert(t, err == nil, err)
+	tAssert(t, backend.Calls() == 2, backend.Calls())
+
+	// stale on error
+	backend.mu.Lock()
+	backend.err = errors.New("backend is down")
+	backend.mu.Unlock()
+
+	c.Invalidate()
+	m, err := c.GetValues([]string{"/key"})
+	tAssert(t, err == nil, err)
+	tAssert(t, m["/key"] == "foobar", m)
+	tAssert(t, c.Stats().StaleHits == 1 && c.Stats().Errors == 1, c.Stats())
+
+	c.MaxStale = 0
+	_, err = c.GetValues([]string{"/key"})
+	tAssert(t, err != nil)
+}
+
+func TestCachedBackend_dedup(t *testing.T) {
+	backend := &tCountingBackend{
+		values:  map[string]string{"/key": "foobar"},
+		release: make(chan struct{}),
+	}
+	c := NewCachedBackend(backend, time.Hour, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := c.GetValues([]string{"/key"})
+			if err != nil || m["/key"] != "foobar" {
+				t.Errorf("values = %v, err = %v", m, err)
+			}
+		}()
+	}
+
+	time.Sleep(time.Second / 10)
+	close(backend.release)
+	wg.Wait()
+
+	tAssert(t, backend.Calls() == 1, backend.Calls())
+	tAssert(t, c.Stats() == CacheStats{Hits: 9, Misses: 1}, c.Stats())
+}
+
+func TestCachedBackend_cancel(t *testing.T) {
+	backend := &tCountingBackend{
+		values:  map[string]string{"/key": "foobar"},
+		release: make(chan struct{}),
+	}
+	c := NewCachedBackend(backend, time.Hour, 0)
+
+	// the first caller gives up, the shared request goes on
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.GetValuesContext(ctx, []string{"/key"})
+		first <- err
+	}()
+	time.Sleep(time.Second / 20)
+
+	second := make(chan error, 1)
+	go func() {
+		m, err := c.GetValuesContext(context.Background(), []string{"/key"})
+		if err == nil && m["/key"] != "foobar" {
+			err = errors.New("unexpected values")
+		}
+		second <- err
+	}()
+	time.Sleep(time.Second / 20)
+
+	cancel()
+	tAssert(t, <-first == context.Canceled)
+
+	close(backend.release)
+	tAssert(t, <-second == nil)
+	tAssert(t, backend.Calls() == 1, backend.Calls())
+}
+
+func TestCachedBackend_WatchPrefix(t *testing.T) {
+	backend := &tCountingBackend{values: map[string]string{"/a/x": "1", "/b/x": "1"}}
+	c := NewCachedBackend(backend, time.Hour, 0)
+
+	c.GetValues([]string{"/a"})
+	c.GetValues([]string{"/b"})
+	tAssert(t, backend.Calls() == 2, backend.Calls())
+
+	backend.mu.Lock()
+	backend.values["/a/x"] = "2"
+	backend.mu.Unlock()
+
+	_, err := c.WatchPrefix("/", []string{"/a/"}, 0, nil)
+	tAssert(t, err == nil, err)
+
+	m, _ := c.GetValues([]string{"/a"})
+	tAssert(t, m["/a/x"] == "2", m)
+	c.GetValues([]string{"/b"})
+	tAssert(t, backend.Calls() == 3, backend.Calls())
+
+	_, err = NewBackendClient(&BackendConfig{Type: CachedBackendType})
+	tAssert(t, err != nil)
+}
+
+func TestCachedBackend_forward(t *testing.T) {
+	// not implemented by the backend
+	c := NewCachedBackend(&tCountingBackend{}, time.Hour, 0)
+	_, ok := toEventWatcher(c)
+	tAssert(t, !ok)
+	_, ok = toSnapshotReader(c)
+	tAssert(t, !ok)
+	_, ok = toKeyAdjuster(c)
+	tAssert(t, !ok)
+	_, err := ToBackendWriter(c)
+	tAssert(t, err != nil)
+
+	c = NewCachedBackend(&tAdjustedBackend{}, time.Hour, 0)
+	_, ok = toSnapshotReader(c)
+	tAssert(t, ok)
+	a, ok := toKeyAdjuster(c)
+	tAssert(t, ok && a.AdjustKey("/a") == "/real/a")
+
+	// the writes and events drop the cached values
+	dir, err := ioutil.TempDir("", "libconfd")
+	tAssert(t, err == nil, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "backend.toml")
+	tWriteFile(t, name, `"/key" = "1"`)
+
+	toml := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}})
+	c = NewCachedBackend(toml, time.Hour, 0)
+	defer c.Close()
+
+	w, ok := toEventWatcher(c)
+	tAssert(t, ok)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := w.WatchEvents(ctx, "/", []string{"/key"}, 0)
+	tAssert(t, err == nil, err)
+	<-events // the first snapshot
+
+	m, err := c.GetValues([]string{"/key"})
+	tAssert(t, err == nil && m["/key"] == "1", m, err)
+
+	writer, err := ToBackendWriter(c)
+	tAssert(t, err == nil, err)
+	tAssert(t, writer.SetValues(ctx, map[string]string{"/key": "2"}) == nil)
+
+	m, err = c.GetValues([]string{"/key"})
+	tAssert(t, err == nil && m["/key"] == "2", m, err)
+
+	// changed by others, the event of the write above may come first
+	tWriteFile(t, name, `"/key" = "3"`)
+	for done := false; !done; {
+		select {
+		case batch := <-events:
+			for _, e := range batch.Events {
+				done = done || e.NewValue == "3"
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	m, err = c.GetValues([]string{"/key"})
+	tAssert(t, err == nil && m["/key"] == "3", m, err)
+}
+
+func TestCachedBackend_evict(t *testing.T) {
+	backend := &tCountingBackend{values: map[string]string{"/key": "foobar"}}
+	c := NewCachedBackend(backend, time.Second/20, time.Second/20)
+
+	for i := 0; i < 10; i++ {
+		_, err := c.GetValues([]string{fmt.Sprintf("/key/%d", i)})
+		tAssert(t, err == nil, err)
+	}
+
+	time.Sleep(time.Second / 5)
+	_, err := c.GetValues([]string{"/key"})
+	tAssert(t, err == nil, err)
+
+	c.mu.Lock()
+	n := len(c.entries)
+	c.mu.Unlock()
+	tAssert(t, n == 1, n)
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const CompositeBackendType = "libconfd-backend-composite"
+
+var (
+	_ BackendClient = (*CompositeBackend)(nil)
+	_ HealthChecker = (*CompositeBackend)(nil)
+)
+
+// CompositeBackend layers an ordered list of backends, the values of
+// later backends override the values of earlier ones.
+//
+// GetValues fails if any backend fails, since the values of the failed
+// layer may override the others. If AllowPartial is set, the failed
+// backends are skipped with a warning, and GetValues fails only if all
+// of them fail; the failures are still reported by HealthCheck.
+//
+// WatchPrefix watches all watch-capable backends, and returns when any
+// of them returns.
+//
+// Example of confd-backend.toml, the TOML defaults are overridden by etcd,
+// which are overridden by environment variables:
+//
+//	type = "libconfd-backend-composite"
+//
+//	[options]
+//	allow_partial = "false"                 # skip the failed backends
+//
+//	[[backends]]
+//	type = "libconfd-backend-toml"
+//	host = ["/etc/myapp/defaults.toml"]
+//
+//	[[backends]]
+//	type = "libconfd-backend-etcdv3"
+//	host = ["127.0.0.1:2379"]
+//
+//	[[backends]]
+//	type = "libconfd-backend-env"
+//	[backends.options]
+//	env_prefix = "MYAPP_"
+type CompositeBackend struct {
+	Backends     []BackendClient
+	AllowPartial bool // skip the failed backends in GetValues
+
+	mu         sync.Mutex
+	index      uint64
+	watchIndex map[uint64]compositeWatchState // returned index => state
+}
+
+// compositeWatchState is the indexes of the backends seen by a returned
+// index of WatchPrefix.
+type compositeWatchState struct {
+	watchKey string // prefix and keys
+	indexes  []uint64
+}
+
+// the max saved states of WatchPrefix, an older index is watched from
+// the current values of the backends
+const compositeMaxWatchStates = 1024
+
+func init() {
+	RegisterBackendClient(
+		CompositeBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewCompositeBackendClient(cfg)
+		},
+	)
+}
+
+// NewCompositeBackendClient creates the backends of cfg.Backends,
+// the HookKeyAdjuster of cfg is used if not set by the child.
+func NewCompositeBackendClient(cfg *BackendConfig) (*CompositeBackend, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf("libconfd: composite backend requires backends")
+	}
+	allowPartial, err := cfg.GetBoolOption("allow_partial", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var backends []BackendClient
+	for _, child := range cfg.Backends {
+		client, err := NewBackendClient(child, func(c *BackendConfig) {
+			if c.HookKeyAdjuster == nil {
+				c.HookKeyAdjuster = cfg.HookKeyAdjuster
+			}
+		})
+		if err != nil {
+			for _, c := range backends {
+				c.Close()
+			}
+			return nil, err
+		}
+		backends = append(backends, client)
+	}
+
+	p := NewCompositeBackend(backends...)
+	p.AllowPartial = allowPartial
+	return p, nil
+}
+
+// NewCompositeBackend returns a CompositeBackend of backends,
+// ordered from the lowest precedence to the highest.
+func NewCompositeBackend(backends ...BackendClient) *CompositeBackend {
+	return &CompositeBackend{
+		Backends:   backends,
+		index:      1,
+		watchIndex: make(map[uint64]compositeWatchState),
+	}
+}
+
+func (_ *CompositeBackend) Type() string {
+	return CompositeBackendType
+}
+
+// WatchEnabled reports whether any of the backends supports watch.
+func (p *CompositeBackend) WatchEnabled() bool {
+	for _, c := range p.Backends {
+		if c.WatchEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CompositeBackend) Close() error {
+	var lastErr error
+	for _, c := range p.Backends {
+		if err := c.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// HealthCheck checks all backends, and returns the first error.
+func (p *CompositeBackend) HealthCheck(ctx context.Context) error {
+	for _, c := range p.Backends {
+		if err := checkBackendHealth(ctx, c); err != nil {
+			return fmt.Errorf("libconfd: %s: %v", c.Type(), err)
+		}
+	}
+	return nil
+}
+
+// GetValues merges the values of all backends, see AllowPartial.
+func (p *CompositeBackend) GetValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	var lastErr error
+	var failed int
+	for _, c := range p.Backends {
+		m, err := c.GetValues(keys)
+		if err != nil {
+			lastErr = fmt.Errorf("libconfd: %s: %v", c.Type(), err)
+			if !p.AllowPartial {
+				return vars, lastErr
+			}
+			GetLogger().Warningf("%v, skipped", lastErr)
+			failed++
+			continue
+		}
+		for k, v := range m {
+			vars[k] = v
+		}
+	}
+
+	if failed == len(p.Backends) {
+		return vars, lastErr
+	}
+	return vars, nil
+}
+
+// WatchPrefix waits until any watch-capable backend returns.
+//
+// Each returned index is mapped to the indexes of the backends it has
+// seen, so the callers watching the same keys from different indexes
+// never miss the changes seen by the others.
+func (p *CompositeBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	watchKey := prefix + "\x00" + strings.Join(keys, "\x00")
+
+	p.mu.Lock()
+	state, ok := p.watchIndex[waitIndex]
+	p.mu.Unlock()
+
+	lastIndex := make([]uint64, len(p.Backends))
+	if ok && waitIndex != 0 && state.watchKey == watchKey && len(state.indexes) == len(lastIndex) {
+		copy(lastIndex, state.indexes)
+	}
+
+	type result struct {
+		i     int
+		index uint64
+		err   error
+	}
+
+	childStop := make(chan bool)
+	resultChan := make(chan result, len(p.Backends))
+
+	var n int
+	for i, c := range p.Backends {
+		if !c.WatchEnabled() {
+			continue
+		}
+		n++
+		go func(i int, c BackendClient) {
+			index, err := c.WatchPrefix(prefix, keys, lastIndex[i], childStop)
+			resultChan <- result{i, index, err}
+		}(i, c)
+	}
+
+	if n == 0 && waitIndex != 0 {
+		<-stopChan
+		return waitIndex, nil
+	}
+
+	var stopped bool
+	var firstErr error
+	var changed bool
+
+	for received := 0; received < n; received++ {
+		var r result
+		select {
+		case r = <-resultChan:
+		case <-stopChan:
+			if !stopped {
+				stopped = true
+				close(childStop)
+			}
+			r = <-resultChan
+		}
+
+		// the first returned backend stops others
+		if !stopped {
+			stopped = true
+			close(childStop)
+		}
+
+		switch {
+		case r.err != nil:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("libconfd: %s: %v", p.Backends[r.i].Type(), r.err)
+			}
+		case r.index != lastIndex[r.i]:
+			lastIndex[r.i] = r.index
+			changed = true
+		}
+	}
+
+	if waitIndex != 0 && !changed {
+		return waitIndex, firstErr
+	}
+
+	// a new index > 0 triggers a key retrieval from the store
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.index++
+	p.watchIndex[p.index] = compositeWatchState{watchKey: watchKey, indexes: lastIndex}
+	if p.index > compositeMaxWatchStates {
+		delete(p.watchIndex, p.index-compositeMaxWatchStates)
+	}
+	return p.index, firstErr
+}
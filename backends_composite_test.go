@@ -0,0 +1,253 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompositeBackend_GetValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultsFile := filepath.Join(dir, "defaults.toml")
+	overrideFile := filepath.Join(dir, "override.json")
+	cfgFile := filepath.Join(dir, "confd-backend.toml")
+
+	tWriteFile(t, defaultsFile, `
+		[db]
+		host = "127.0.0.1"
+		port = "3306"
+	`)
+	tWriteFile(t, overrideFile, `{"db": {"host": "10.0.0.1"}}`)
+	tWriteFile(t, cfgFile, fmt.Sprintf(`
+		type = %q
+
+		[[backends]]
+		type = %q
+		host = [%q]
+
+		[[backends]]
+		type = %q
+		host = [%q]
+
+		[[backends]]
+		type = %q
+		[backends.options]
+		env_prefix = "LIBCONFD_COMPOSITE_"
+	`,
+		CompositeBackendType,
+		TomlBackendType, defaultsFile,
+		JsonBackendType, overrideFile,
+		EnvBackendType,
+	))
+
+	os.Setenv("LIBCONFD_COMPOSITE_DB_PORT", "3307")
+	defer os.Unsetenv("LIBCONFD_COMPOSITE_DB_PORT")
+
+	cfg, err := LoadBackendConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tAssert(t, len(cfg.Backends) == 3, cfg.Backends)
+
+	c := MustNewBackendClient(cfg)
+	defer c.Close()
+
+	tAssert(t, c.WatchEnabled())
+
+	m, err := c.GetValues([]string{"/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/db/host": "10.0.0.1",
+		"/db/port": "3307",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
+
+	// no backends
+	_, err = NewBackendClient(&BackendConfig{Type: CompositeBackendType})
+	tAssert(t, err != nil)
+}
+
+func TestCompositeBackend_allowPartial(t *testing.T) {
+	down := &tCountingBackend{err: errors.New("backend is down")}
+	up := &tCountingBackend{values: map[string]string{"/key": "foobar"}}
+
+	c := NewCompositeBackend(up, down)
+	_, err := c.GetValues([]string{"/key"})
+	tAssert(t, err != nil)
+
+	c.AllowPartial = true
+	m, err := c.GetValues([]string{"/key"})
+	tAssert(t, err == nil, err)
+	tAssert(t, reflect.DeepEqual(m, map[string]string{"/key": "foobar"}), m)
+
+	// the failed layer is still reported
+	tAssert(t, c.HealthCheck(context.Background()) != nil)
+
+	// all layers failed
+	c = NewCompositeBackend(down, down)
+	c.AllowPartial = true
+	_, err = c.GetValues([]string{"/key"})
+	tAssert(t, err != nil)
+
+	// option
+	c, err = NewCompositeBackendClient(&BackendConfig{
+		Type:     CompositeBackendType,
+		Options:  map[string]string{"allow_partial": "true"},
+		Backends: []*BackendConfig{{Type: EnvBackendType}},
+	})
+	tAssert(t, err == nil, err)
+	tAssert(t, c.AllowPartial)
+	c.Close()
+}
+
+func TestCompositeBackend_WatchPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultsFile := filepath.Join(dir, "defaults.toml")
+	overrideFile := filepath.Join(dir, "override.toml")
+
+	tWriteFile(t, defaultsFile, `"/a/x" = "1"`)
+	tWriteFile(t, overrideFile, `"/b/x" = "1"`)
+
+	c := NewCompositeBackend(
+		NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{defaultsFile}}),
+		NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{overrideFile}}),
+	)
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	keys := []string{"/a", "/b"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tAssert(t, index > 0, index)
+
+	type result struct {
+		index uint64
+		err   error
+	}
+	watch := func(waitIndex uint64) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", keys, waitIndex, stopChan)
+			ch <- result{index, err}
+		}()
+		return ch
+	}
+	expectWakeup := func(ch chan result) {
+		t.Helper()
+		select {
+		case r := <-ch:
+			tAssert(t, r.err == nil, r.err)
+			tAssertf(t, r.index > index, "index = %d, last = %d", r.index, index)
+			index = r.index
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	ch := watch(index)
+	tWriteFile(t, overrideFile, `"/b/x" = "2"`)
+	expectWakeup(ch)
+
+	ch = watch(index)
+	tWriteFile(t, defaultsFile, `"/a/x" = "2"`)
+	expectWakeup(ch)
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+	select {
+	case r := <-ch:
+		tAssert(t, r.err == nil, r.err)
+		tAssertf(t, r.index == index, "index = %d, last = %d", r.index, index)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestCompositeBackend_WatchPrefix_sharedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "backend.toml")
+	tWriteFile(t, name, `"/a/x" = "1"`)
+
+	c := NewCompositeBackend(
+		NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}}),
+	)
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	keys := []string{"/a"}
+
+	// two templates of the same keys
+	index1, err := c.WatchPrefix("/", keys, 0, stopChan)
+	tAssert(t, err == nil, err)
+	index2, err := c.WatchPrefix("/", keys, 0, stopChan)
+	tAssert(t, err == nil, err)
+
+	tWriteFile(t, name, `"/a/x" = "2"`)
+
+	watch := func(waitIndex uint64) uint64 {
+		t.Helper()
+
+		ch := make(chan uint64, 1)
+		go func() {
+			index, _ := c.WatchPrefix("/", keys, waitIndex, stopChan)
+			ch <- index
+		}()
+		select {
+		case index := <-ch:
+			tAssertf(t, index != waitIndex, "index = %d", index)
+			return index
+		case <-time.After(5 * time.Second):
+			t.Fatal("change is missed")
+		}
+		return 0
+	}
+
+	// the second one sees the change seen by the first one
+	watch(index1)
+	watch(index2)
+}
+
+func tWriteFile(tb testing.TB, name, content string) {
+	tb.Helper()
+
+	// atomic rename, like most editors
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DirBackendType = "libconfd-backend-dir"
+
+var (
+	_ BackendClient = (*DirBackend)(nil)
+	_ EventWatcher  = (*DirBackend)(nil)
+)
+
+// DirBackend uses a directory tree as the key space, the content of
+// file <Dir>/db/host is the value of key /db/host.
+//
+// It works with Kubernetes ConfigMap/Secret volumes: entries starting
+// with ".." (the kubelet's ..data symlink and timestamped dirs) are
+// skipped, other symlinks are followed, so the atomic ..data swap is
+// seen as a single change.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["/etc/myapp-kv"]
+//
+//	[options]
+//	trim_space = "true" # trim spaces and newlines of values (false)
+type DirBackend struct {
+	Dir       string
+	TrimSpace bool
+
+	dirsMutex sync.Mutex
+	dirs      []string // dirs found by last GetValues
+
+	watcherOnce sync.Once
+	watcher     *fileWatcher
+}
+
+func init() {
+	RegisterBackendClient(
+		DirBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewDirBackendClient(cfg)
+		},
+	)
+}
+
+func NewDirBackendClient(cfg *BackendConfig) (*DirBackend, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("libconfd: dir backend requires host")
+	}
+
+	trimSpace, err := cfg.GetBoolOption("trim_space", false)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &DirBackend{
+		Dir:       filepath.Clean(cfg.Host[0]),
+		TrimSpace: trimSpace,
+	}
+	return p, nil
+}
+
+func (p *DirBackend) Close() error {
+	return p.getWatcher().Close()
+}
+
+func (_ *DirBackend) Type() string {
+	return DirBackendType
+}
+
+func (_ *DirBackend) WatchEnabled() bool {
+	return true
+}
+
+// WatchPrefix waits until a file under keys is changed.
+func (p *DirBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return p.getWatcher().WatchPrefix(prefix, keys, waitIndex, stopChan)
+}
+
+// WatchEvents sends the change events of keys under keys.
+func (p *DirBackend) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error) {
+	return p.getWatcher().WatchEvents(ctx, prefix, keys, revision)
+}
+
+func (p *DirBackend) GetValues(keys []string) (map[string]string, error) {
+	fi, err := os.Stat(p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("libconfd: %s is not a directory", p.Dir)
+	}
+
+	vars := make(map[string]string)
+	dirs := []string{p.Dir}
+	visited := make(map[string]bool)
+
+	if err := p.walk(p.Dir, "", vars, &dirs, visited); err != nil {
+		return nil, err
+	}
+
+	p.dirsMutex.Lock()
+	p.dirs = dirs
+	p.dirsMutex.Unlock()
+
+	return vars, nil
+}
+
+func (p *DirBackend) walk(dir, key string, vars map[string]string, dirs *[]string, visited map[string]bool) error {
+	// avoid symlink loops
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if visited[realDir] {
+		return nil
+	}
+	visited[realDir] = true
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "..") {
+			continue
+		}
+
+		abspath := filepath.Join(dir, name)
+
+		// follow symlinks
+		fi, err := os.Stat(abspath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // dangling symlink
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			*dirs = append(*dirs, abspath)
+			if err := p.walk(abspath, key+"/"+name, vars, dirs, visited); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadFile(abspath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed while walking
+			}
+			return err
+		}
+
+		if p.TrimSpace {
+			vars[key+"/"+name] = strings.TrimSpace(string(data))
+		} else {
+			vars[key+"/"+name] = string(data)
+		}
+	}
+
+	return nil
+}
+
+func (p *DirBackend) getWatcher() *fileWatcher {
+	p.watcherOnce.Do(func() {
+		p.watcher = newFileWatcher(
+			func() (map[string]string, error) { return p.GetValues(nil) },
+			func() []string {
+				p.dirsMutex.Lock()
+				defer p.dirsMutex.Unlock()
+
+				if len(p.dirs) == 0 {
+					return []string{p.Dir}
+				}
+				return append([]string{}, p.dirs...)
+			},
+			0,
+		)
+	})
+	return p.watcher
+}
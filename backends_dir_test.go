@@ -0,0 +1,137 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tWriteConfigMapDir writes files like the kubelet does:
+//
+//	..2018_01_02_03_04_05.000/db/host
+//	..data -> ..2018_01_02_03_04_05.000
+//	db -> ..data/db
+func tWriteConfigMapDir(tb testing.TB, root, version string, files map[string]string) {
+	tb.Helper()
+
+	tsDir := filepath.Join(root, "..2018_01_02_03_04_05."+version)
+	for name, content := range files {
+		abspath := filepath.Join(tsDir, name)
+		if err := os.MkdirAll(filepath.Dir(abspath), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(abspath, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	tmpLink := filepath.Join(root, "..data_tmp")
+	if err := os.Symlink(filepath.Base(tsDir), tmpLink); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(root, "..data")); err != nil {
+		tb.Fatal(err)
+	}
+
+	for name := range files {
+		top := filepath.Join(root, tFirstPathElem(name))
+		if _, err := os.Lstat(top); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join("..data", tFirstPathElem(name)), top); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func tFirstPathElem(name string) string {
+	for {
+		dir := filepath.Dir(name)
+		if dir == "." {
+			return name
+		}
+		name = dir
+	}
+}
+
+func TestDirBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tWriteConfigMapDir(t, root, "001", map[string]string{
+		"db/host": "127.0.0.1\n",
+		"db/port": "3306",
+		"key":     "foobar",
+	})
+
+	c := MustNewBackendClient(&BackendConfig{
+		Type:    DirBackendType,
+		Host:    []string{root},
+		Options: map[string]string{"trim_space": "true"},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+		"/key":     "foobar",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
+
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/", []string{"/db"}, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan uint64, 1)
+	go func() {
+		index, _ := c.WatchPrefix("/", []string{"/db"}, index, stopChan)
+		ch <- index
+	}()
+
+	// swap ..data
+	tWriteConfigMapDir(t, root, "002", map[string]string{
+		"db/host": "10.0.0.1\n",
+		"db/port": "3306",
+		"key":     "foobar",
+	})
+
+	select {
+	case newIndex := <-ch:
+		tAssertf(t, newIndex > index, "index = %d, last = %d", newIndex, index)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	m, err = c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tAssert(t, m["/db/host"] == "10.0.0.1", m)
+}
+
+func TestDirBackend_notDir(t *testing.T) {
+	c := MustNewBackendClient(&BackendConfig{
+		Type: DirBackendType,
+		Host: []string{"./confd-backend.toml"},
+	})
+	defer c.Close()
+
+	_, err := c.GetValues([]string{"/"})
+	tAssert(t, err != nil)
+}
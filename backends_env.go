@@ -0,0 +1,314 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const EnvBackendType = "libconfd-backend-env"
+
+var _ BackendClient = (*EnvBackend)(nil)
+
+// EnvBackend reads keys from environment variables.
+//
+// The key is mapped to the variable name by trimming the leading "/",
+// joining the key segments with Separator, applying Case and adding
+// VarPrefix, so /db/host is read from DB_HOST by default.
+//
+// The variables under a queried key are mapped back to keys by splitting
+// the name with Separator, except for the default "_", which can not be
+// told from the underscores in the key names. So with the default, DB_MAX_CONN
+// is /db/max_conn when /db is queried, and /db_max_conn when / is queried.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["/proc/1/environ"] # optional env-file or /proc/<pid>/environ
+//
+//	[options]
+//	env_prefix = "MYAPP_"      # variable name prefix, stripped from keys
+//	env_separator = "__"       # key segment separator ("_")
+//	env_case = "upper"         # upper/lower/preserve ("upper")
+//	poll_interval = "1s"       # reload interval of host file
+type EnvBackend struct {
+	// VarPrefix is the prefix of variable names, it is not part of the keys.
+	VarPrefix string
+
+	// Separator joins key segments in variable names. ("_")
+	Separator string
+
+	// Case of variable names: upper/lower/preserve. ("upper")
+	Case string
+
+	// EnvFile is an env-file (KEY=VALUE lines) or a /proc/<pid>/environ file.
+	// If empty, the environment of current process is used.
+	EnvFile string
+
+	// PollInterval is the reload interval of EnvFile in watch mode.
+	// If zero, /proc files are polled every second, other files are
+	// reloaded on filesystem notifications.
+	PollInterval time.Duration
+
+	watcherOnce sync.Once
+	watcher     *fileWatcher
+}
+
+func init() {
+	RegisterBackendClient(
+		EnvBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewEnvBackendClient(cfg)
+		},
+	)
+}
+
+func NewEnvBackendClient(cfg *BackendConfig) (*EnvBackend, error) {
+	p := &EnvBackend{
+		VarPrefix: cfg.GetOption("env_prefix", ""),
+		Separator: cfg.GetOption("env_separator", "_"),
+		Case:      cfg.GetOption("env_case", "upper"),
+	}
+	if len(cfg.Host) > 0 {
+		p.EnvFile = cfg.Host[0]
+	}
+
+	var err error
+	if p.PollInterval, err = cfg.GetDurationOption("poll_interval", 0); err != nil {
+		return nil, err
+	}
+
+	switch p.Case {
+	case "upper", "lower", "preserve":
+	default:
+		return nil, fmt.Errorf("libconfd: invalid env_case %q", p.Case)
+	}
+	if p.Separator == "" {
+		return nil, fmt.Errorf("libconfd: empty env_separator")
+	}
+
+	return p, nil
+}
+
+func (p *EnvBackend) Close() error {
+	return p.getWatcher().Close()
+}
+
+func (_ *EnvBackend) Type() string {
+	return EnvBackendType
+}
+
+// WatchEnabled reports whether EnvFile is set,
+// the environment of current process never changes.
+func (p *EnvBackend) WatchEnabled() bool {
+	return p.EnvFile != ""
+}
+
+// GetValues queries the environment for keys
+func (p *EnvBackend) GetValues(keys []string) (map[string]string, error) {
+	envMap, err := p.readEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	for _, key := range keys {
+		for name, value := range envMap {
+			if k, ok := p.varNameToKey(key, name); ok {
+				vars[k] = value
+			}
+		}
+	}
+
+	return vars, nil
+}
+
+// WatchPrefix waits until a variable under keys is changed in EnvFile.
+func (p *EnvBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	// the watcher tracks the variable names, see watchKey
+	watchKeys := make([]string, len(keys))
+	for i, key := range keys {
+		watchKeys[i], _ = p.watchKey(p.keyToVarName(key))
+	}
+	return p.getWatcher().WatchPrefix(prefix, watchKeys, waitIndex, stopChan)
+}
+
+func (p *EnvBackend) getWatcher() *fileWatcher {
+	p.watcherOnce.Do(func() {
+		pollInterval := p.PollInterval
+		if pollInterval == 0 && strings.HasPrefix(p.EnvFile, "/proc/") {
+			pollInterval = defaultWatcherPollInterval
+		}
+
+		p.watcher = newFileWatcher(
+			p.readWatchKeys,
+			func() []string {
+				// procfs does not support inotify
+				if p.EnvFile == "" || strings.HasPrefix(p.EnvFile, "/proc/") {
+					return nil
+				}
+				return fileDirs(p.EnvFile)
+			},
+			pollInterval,
+		)
+	})
+	return p.watcher
+}
+
+// readWatchKeys reads the variables under VarPrefix by watchKey.
+func (p *EnvBackend) readWatchKeys() (map[string]string, error) {
+	envMap, err := p.readEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	for name, value := range envMap {
+		if k, ok := p.watchKey(name); ok {
+			m[k] = value
+		}
+	}
+	return m, nil
+}
+
+// watchKey maps the variable name to the key tracked by the watcher, the
+// name is split by Separator, so the prefix of a key matches the variables
+// of its sub keys. The watch keys are never returned to the caller.
+func (p *EnvBackend) watchKey(name string) (string, bool) {
+	if !strings.HasPrefix(name, p.VarPrefix) {
+		return "", false
+	}
+	name = name[len(p.VarPrefix):]
+	return "/" + strings.Replace(name, p.Separator, "/", -1), true
+}
+
+// keyToVarName maps the key to the variable name.
+func (p *EnvBackend) keyToVarName(key string) string {
+	key = strings.Trim(path.Clean("/"+key), "/")
+	name := strings.Replace(key, "/", p.Separator, -1)
+
+	switch p.Case {
+	case "upper":
+		name = strings.ToUpper(name)
+	case "lower":
+		name = strings.ToLower(name)
+	}
+
+	return p.VarPrefix + name
+}
+
+// varNameToKey maps the variable name back to a key under the queried key.
+//
+// The queried key part is kept as is, so /db/max_conn is not mangled to
+// /db/max/conn; only the remaining part is split by Separator, unless
+// Separator is "_".
+func (p *EnvBackend) varNameToKey(key, name string) (string, bool) {
+	key = path.Clean("/" + key)
+	base := p.keyToVarName(key)
+
+	var rest string
+	switch {
+	case name == base:
+		return key, true
+	case key == "/" && strings.HasPrefix(name, base):
+		rest = name[len(base):]
+	case strings.HasPrefix(name, base+p.Separator):
+		rest = name[len(base)+len(p.Separator):]
+	default:
+		return "", false
+	}
+	if rest == "" {
+		return "", false
+	}
+
+	if p.Case == "upper" {
+		rest = strings.ToLower(rest)
+	}
+	if p.Separator != "_" {
+		rest = strings.Replace(rest, p.Separator, "/", -1)
+	}
+	return path.Join(key, rest), true
+}
+
+// readEnv reads the variables from EnvFile or current process.
+func (p *EnvBackend) readEnv() (map[string]string, error) {
+	if p.EnvFile == "" {
+		return parseEnvList(os.Environ()), nil
+	}
+
+	data, err := ioutil.ReadFile(p.EnvFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// /proc/<pid>/environ is NUL separated
+	if bytes.IndexByte(data, 0) >= 0 {
+		return parseEnvList(strings.Split(string(data), "\x00")), nil
+	}
+
+	return parseEnvFile(data)
+}
+
+func parseEnvList(list []string) map[string]string {
+	m := make(map[string]string)
+	for _, s := range list {
+		if idx := strings.Index(s, "="); idx > 0 {
+			m[s[:idx]] = s[idx+1:]
+		}
+	}
+	return m
+}
+
+// parseEnvFile parses KEY=VALUE lines.
+// Empty lines, # comments and the export keyword are ignored,
+// quoted values are unquoted.
+func parseEnvFile(data []byte) (map[string]string, error) {
+	m := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		idx := strings.Index(line, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("libconfd: invalid env line %d: %q", lineno, line)
+		}
+
+		name := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+
+		if n := len(value); n >= 2 {
+			switch {
+			case value[0] == '"' && value[n-1] == '"':
+				s, err := strconv.Unquote(value)
+				if err != nil {
+					return nil, fmt.Errorf("libconfd: invalid env line %d: %v", lineno, err)
+				}
+				value = s
+			case value[0] == '\'' && value[n-1] == '\'':
+				value = value[1 : n-1]
+			}
+		}
+
+		m[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -1,81 +1,159 @@
-// Copyright confd. All rights reserved.
-// Use of this source code is governed by a MIT-style
-// license that can be found in the LICENSE-confd file.
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
 
 package libconfd
 
 import (
+	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
 )
 
-// tEnvClient provides a shell for the env client
-type tEnvClient struct{}
+func TestEnvBackend_GetValues(t *testing.T) {
+	os.Setenv("LIBCONFD_TEST_DB_HOST", "127.0.0.1")
+	os.Setenv("LIBCONFD_TEST_DB_MAX_CONN", "100")
+	os.Setenv("LIBCONFD_TEST_DBX", "skip")
+	defer os.Unsetenv("LIBCONFD_TEST_DB_HOST")
+	defer os.Unsetenv("LIBCONFD_TEST_DB_MAX_CONN")
+	defer os.Unsetenv("LIBCONFD_TEST_DBX")
+
+	c := MustNewBackendClient(&BackendConfig{
+		Type:    EnvBackendType,
+		Options: map[string]string{"env_prefix": "LIBCONFD_TEST_"},
+	})
+	defer c.Close()
+
+	tAssert(t, !c.WatchEnabled())
+
+	m, err := c.GetValues([]string{"/db/max_conn", "/db/host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/db/host":     "127.0.0.1",
+		"/db/max_conn": "100",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
 
-func init() {
-	RegisterBackendClient(
-		(*tEnvClient)(nil).Type(),
-		func(cfg *BackendConfig) (BackendClient, error) {
-			p := tNewEnvClient()
-			return p, nil
-		},
-	)
-}
+	m, err = c.GetValues([]string{"/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = map[string]string{
+		"/db/host":     "127.0.0.1",
+		"/db/max_conn": "100",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
 
-// tNewEnvClient returns a new client
-func tNewEnvClient() BackendClient {
-	return new(tEnvClient)
+	m, err = c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tAssert(t, m["/db_max_conn"] == "100", m)
 }
 
-func (_ *tEnvClient) Type() string {
-	return "libconfd-backend-internal-env"
-}
+func TestEnvBackend_separator(t *testing.T) {
+	p, err := NewEnvBackendClient(&BackendConfig{
+		Type: EnvBackendType,
+		Options: map[string]string{
+			"env_separator": "__",
+			"env_case":      "preserve",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tAssert(t, p.keyToVarName("/db/max_conn") == "db__max_conn", p.keyToVarName("/db/max_conn"))
 
-func (_ *tEnvClient) Close() error {
-	return nil
+	key, ok := p.varNameToKey("/db", "db__max_conn")
+	tAssert(t, ok)
+	tAssert(t, key == "/db/max_conn", key)
+
+	key, ok = p.varNameToKey("/", "DB__Host")
+	tAssert(t, ok)
+	tAssert(t, key == "/DB/Host", key)
+
+	_, ok = p.varNameToKey("/db", "dbx__host")
+	tAssert(t, !ok)
 }
 
-func (_ *tEnvClient) WatchEnabled() bool {
-	return false
+func TestEnvBackend_invalidOptions(t *testing.T) {
+	_, err := NewEnvBackendClient(&BackendConfig{
+		Type:    EnvBackendType,
+		Options: map[string]string{"env_case": "camel"},
+	})
+	tAssert(t, err != nil)
 }
 
-// GetValues queries the environment for keys
-func (_ *tEnvClient) GetValues(keys []string) (map[string]string, error) {
-	allEnvVars := os.Environ()
-	envMap := make(map[string]string)
-	for _, e := range allEnvVars {
-		index := strings.Index(e, "=")
-		envMap[e[:index]] = e[index+1:]
+func TestParseEnvFile(t *testing.T) {
+	m, err := parseEnvFile([]byte(`
+# comment
+A=1
+export B = "x\ty"
+C='$HOME'
+D=
+`))
+	if err != nil {
+		t.Fatal(err)
 	}
+	expect := map[string]string{"A": "1", "B": "x\ty", "C": "$HOME", "D": ""}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
 
-	vars := make(map[string]string)
+	_, err = parseEnvFile([]byte("A"))
+	tAssert(t, err != nil)
+}
 
-	transform := func(key string) string {
-		var replacer = strings.NewReplacer("/", "_")
+func TestEnvBackend_WatchPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
-		k := strings.TrimPrefix(key, "/")
-		return strings.ToUpper(replacer.Replace(k))
+	name := filepath.Join(dir, "app.env")
+	if err := ioutil.WriteFile(name, []byte("DB_MAX_CONN=1\nAPP_NAME=a\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
-	clean := func(key string) string {
-		var cleanReplacer = strings.NewReplacer("_", "/")
 
-		newKey := "/" + key
-		return cleanReplacer.Replace(strings.ToLower(newKey))
+	c := MustNewBackendClient(&BackendConfig{
+		Type: EnvBackendType,
+		Host: []string{name},
+	})
+	defer c.Close()
+
+	tAssert(t, c.WatchEnabled())
+
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/", []string{"/db"}, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, key := range keys {
-		k := transform(key)
-		for envKey, envValue := range envMap {
-			if strings.HasPrefix(envKey, k) {
-				vars[clean(envKey)] = envValue
-			}
-		}
+	ch := make(chan uint64, 1)
+	go func() {
+		index, _ := c.WatchPrefix("/", []string{"/db"}, index, stopChan)
+		ch <- index
+	}()
+
+	if err := ioutil.WriteFile(name, []byte("DB_MAX_CONN=2\nAPP_NAME=a\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	return vars, nil
-}
+	select {
+	case newIndex := <-ch:
+		tAssertf(t, newIndex > index, "index = %d, last = %d", newIndex, index)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
 
-func (_ *tEnvClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	<-stopChan
-	return 0, nil
+	m, err := c.GetValues([]string{"/db/max_conn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tAssert(t, m["/db/max_conn"] == "2", m)
 }
@@ -0,0 +1,203 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	JsonBackendType = "libconfd-backend-json"
+	YamlBackendType = "libconfd-backend-yaml"
+)
+
+var (
+	_ BackendClient = (*FileBackend)(nil)
+	_ EventWatcher  = (*FileBackend)(nil)
+)
+
+// FileBackend reads keys from nested JSON or YAML documents.
+//
+// The documents are flattened into /a/b/c keys, array items are indexed
+// by position or by their name field. Multiple files are merged in order
+// before flattening, the objects are merged by key, and the other values,
+// include arrays, of later files replace the values of earlier ones.
+type FileBackend struct {
+	Files []string
+
+	typeName  string
+	unmarshal func(data []byte, v interface{}) error
+
+	watcherOnce sync.Once
+	watcher     *fileWatcher
+}
+
+func init() {
+	RegisterBackendClient(
+		JsonBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewJsonBackendClient(cfg), nil
+		},
+	)
+	RegisterBackendClient(
+		YamlBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewYamlBackendClient(cfg), nil
+		},
+	)
+}
+
+func NewJsonBackendClient(cfg *BackendConfig) *FileBackend {
+	GetLogger().Assert(cfg.Type == JsonBackendType)
+	return &FileBackend{
+		Files:     append([]string{}, cfg.Host...),
+		typeName:  JsonBackendType,
+		unmarshal: json.Unmarshal,
+	}
+}
+
+func NewYamlBackendClient(cfg *BackendConfig) *FileBackend {
+	GetLogger().Assert(cfg.Type == YamlBackendType)
+	return &FileBackend{
+		Files:    append([]string{}, cfg.Host...),
+		typeName: YamlBackendType,
+		unmarshal: func(data []byte, v interface{}) error {
+			return yaml.Unmarshal(data, v)
+		},
+	}
+}
+
+func (p *FileBackend) Close() error {
+	return p.getWatcher().Close()
+}
+
+func (p *FileBackend) Type() string {
+	return p.typeName
+}
+
+func (_ *FileBackend) WatchEnabled() bool {
+	return true
+}
+
+// WatchPrefix waits until a key under keys is changed in any of the files.
+func (p *FileBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return p.getWatcher().WatchPrefix(prefix, keys, waitIndex, stopChan)
+}
+
+// WatchEvents sends the change events of keys under keys.
+func (p *FileBackend) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error) {
+	return p.getWatcher().WatchEvents(ctx, prefix, keys, revision)
+}
+
+func (p *FileBackend) GetValues(keys []string) (map[string]string, error) {
+	var tree interface{}
+	for _, name := range p.Files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var doc interface{}
+		if err := p.unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("libconfd: decode %s failed: %v", name, err)
+		}
+
+		tree = mergeTree(tree, doc)
+	}
+
+	vars := make(map[string]string)
+	if err := FlattenTree("", tree, vars); err != nil {
+		return nil, fmt.Errorf("libconfd: decode %v failed: %v", p.Files, err)
+	}
+
+	// the root is not a valid key
+	delete(vars, "")
+
+	return vars, nil
+}
+
+func (p *FileBackend) getWatcher() *fileWatcher {
+	p.watcherOnce.Do(func() {
+		p.watcher = newFileWatcher(
+			func() (map[string]string, error) { return p.GetValues(nil) },
+			func() []string { return fileDirs(p.Files...) },
+			0,
+		)
+	})
+	return p.watcher
+}
+
+// mergeTree merges the decoded value src into dst, the objects are merged
+// by key, other values of src replace the values of dst.
+func mergeTree(dst, src interface{}) interface{} {
+	dstMap, ok1 := dst.(map[string]interface{})
+	srcMap, ok2 := src.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return src
+	}
+
+	for k, v := range srcMap {
+		dstMap[k] = mergeTree(dstMap[k], v)
+	}
+	return dstMap
+}
+
+// KeyHasPrefix reports whether key is prefix or a sub key of prefix,
+// so /db matches /db/host but not /dbx.
+func KeyHasPrefix(key, prefix string) bool {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if key == prefix {
+		return true
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return strings.HasPrefix(key, prefix+"/")
+}
+
+// FlattenTree flattens the decoded JSON value into vars with the keys
+// under root. The array items are indexed by their name field if it is
+// a string, otherwise by position.
+func FlattenTree(root string, val interface{}, vars map[string]string) error {
+	switch val.(type) {
+	case map[string]interface{}:
+		for k := range val.(map[string]interface{}) {
+			if err := FlattenTree(strings.Join([]string{root, k}, "/"), val.(map[string]interface{})[k], vars); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range val.([]interface{}) {
+			idx := strconv.Itoa(i)
+			if i, isMap := item.(map[string]interface{}); isMap {
+				if name, ok := i["name"].(string); ok {
+					idx = name
+				}
+			}
+
+			if err := FlattenTree(strings.Join([]string{root, idx}, "/"), item, vars); err != nil {
+				return err
+			}
+		}
+	case bool:
+		vars[root] = strconv.FormatBool(val.(bool))
+	case string:
+		vars[root] = val.(string)
+	case float64:
+		vars[root] = strconv.FormatFloat(val.(float64), 'f', -1, 64)
+	case nil:
+		vars[root] = "null"
+	default:
+		return fmt.Errorf("unknown type: %s", reflect.TypeOf(val))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestYamlBackend(t *testing.T) {
+	c := MustNewBackendClient(&BackendConfig{
+		Type: YamlBackendType,
+		Host: []string{"./testdata/backend/base.yaml"},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/database/host":      "127.0.0.1",
+		"/database/port":      "3306",
+		"/database/enabled":   "true",
+		"/upstream/app1/name": "app1",
+		"/upstream/app1/addr": "10.0.1.10:8080",
+		"/upstream/app2/name": "app2",
+		"/upstream/app2/addr": "10.0.1.11:8080",
+		"/tags/0":             "a",
+		"/tags/1":             "b",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
+}
+
+func TestJsonBackend_merge(t *testing.T) {
+	c := MustNewBackendClient(&BackendConfig{
+		Type: JsonBackendType,
+		Host: []string{
+			"./testdata/backend/base.json",
+			"./testdata/backend/override.json",
+		},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tAssert(t, m["/database/host"] == "10.0.0.1", m["/database/host"])
+	tAssert(t, m["/database/port"] == "3306", m["/database/port"])
+	tAssert(t, m["/database/password"] == "null", m["/database/password"])
+	tAssert(t, m["/upstream/app1/addr"] == "10.0.1.10:8080", m["/upstream/app1/addr"])
+
+	// the shorter array replaces the array of base.json
+	tAssert(t, m["/tags/0"] == "c", m["/tags/0"])
+	_, ok := m["/tags/1"]
+	tAssert(t, !ok, m)
+
+	c = MustNewBackendClient(&BackendConfig{
+		Type: JsonBackendType,
+		Host: []string{"./testdata/backend/override.json"},
+	})
+	defer c.Close()
+
+	m, err = c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/database/host":     "10.0.0.1",
+		"/database/password": "null",
+		"/tags/0":            "c",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
+}
+
+func TestJsonBackend_invalid(t *testing.T) {
+	c := MustNewBackendClient(&BackendConfig{
+		Type: JsonBackendType,
+		Host: []string{"./testdata/backend/base.yaml"},
+	})
+	defer c.Close()
+
+	_, err := c.GetValues([]string{"/"})
+	tAssert(t, err != nil)
+}
+
+func TestKeyHasPrefix(t *testing.T) {
+	for _, c := range []struct {
+		key, prefix string
+		expect      bool
+	}{
+		{"/db", "/db", true},
+		{"/db/host", "/db", true},
+		{"/db/host", "/db/", true},
+		{"/db/host", "db", true},
+		{"/db/host", "/", true},
+		{"/db/host", "", true},
+		{"/dbx", "/db", false},
+		{"/db", "/db/host", false},
+	} {
+		got := KeyHasPrefix(c.key, c.prefix)
+		tAssertf(t, got == c.expect, "KeyHasPrefix(%q, %q) = %v", c.key, c.prefix, got)
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const HttpBackendType = "libconfd-backend-http"
+
+var (
+	_ BackendClient = (*HttpBackend)(nil)
+	_ EventWatcher  = (*HttpBackend)(nil)
+)
+
+// HttpBackend reads keys from JSON or YAML documents served over HTTP.
+//
+// The documents are flattened like FileBackend, multiple URLs are merged
+// in order, later ones override earlier ones. The documents are fetched
+// with If-None-Match if the server sent an ETag, so an unchanged document
+// is not downloaded again.
+//
+// In watch mode, the documents are polled every PollInterval. If
+// LongPollWait is set, the request also asks the server to hold the
+// response until the document is changed with "Prefer: wait=<seconds>"
+// and the optional LongPollParam query, and the next request is sent as
+// soon as the response returns.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["http://127.0.0.1:8080/config.json"]
+//	user/password                           # basic auth, or bearer token if no user
+//	client_ca_keys/client_cert/client_key   # TLS config of https
+//
+//	[options]
+//	format = "json"                         # json/yaml ("json")
+//	request_timeout = "10s"
+//	poll_interval = "30s"                   # "1s" if long_poll_wait is set
+//	long_poll_wait = "0s"                   # only for a single host
+//	long_poll_param = ""                    # e.g. "wait", sent as wait=<seconds>
+type HttpBackend struct {
+	URLs []string
+
+	Format         string
+	RequestTimeout time.Duration
+	PollInterval   time.Duration
+	LongPollWait   time.Duration
+	LongPollParam  string
+
+	userName   string
+	password   string
+	unmarshal  func(data []byte, v interface{}) error
+	httpClient *http.Client
+
+	// cancelled by Close to stop the long polling
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	cache map[string]httpDocument // url => last document
+
+	watcherOnce sync.Once
+	watcher     *fileWatcher
+}
+
+// httpDocument is the flattened document with its ETag.
+type httpDocument struct {
+	etag   string
+	values map[string]string
+}
+
+func init() {
+	RegisterBackendClient(
+		HttpBackendType,
+		func(cfg *BackendConfig) (BackendClient, error) {
+			return NewHttpBackendClient(cfg)
+		},
+	)
+}
+
+func NewHttpBackendClient(cfg *BackendConfig) (*HttpBackend, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("libconfd: empty http backend host")
+	}
+
+	p := &HttpBackend{
+		URLs:          append([]string{}, cfg.Host...),
+		Format:        cfg.GetOption("format", "json"),
+		LongPollParam: cfg.GetOption("long_poll_param", ""),
+		userName:      cfg.UserName,
+		password:      cfg.Password,
+		cache:         make(map[string]httpDocument),
+	}
+
+	var err error
+	if p.RequestTimeout, err = cfg.GetDurationOption("request_timeout", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if p.LongPollWait, err = cfg.GetDurationOption("long_poll_wait", 0); err != nil {
+		return nil, err
+	}
+
+	defaultPollInterval := 30 * time.Second
+	if p.LongPollWait > 0 {
+		defaultPollInterval = time.Second
+	}
+	if p.PollInterval, err = cfg.GetDurationOption("poll_interval", defaultPollInterval); err != nil {
+		return nil, err
+	}
+
+	if p.RequestTimeout <= 0 || p.PollInterval <= 0 || p.LongPollWait < 0 {
+		return nil, fmt.Errorf("libconfd: invalid http backend request_timeout/poll_interval/long_poll_wait")
+	}
+	if p.LongPollWait > 0 && len(p.URLs) > 1 {
+		return nil, fmt.Errorf("libconfd: long_poll_wait of http backend needs a single host")
+	}
+
+	switch p.Format {
+	case "json":
+		p.unmarshal = json.Unmarshal
+	case "yaml":
+		p.unmarshal = func(data []byte, v interface{}) error {
+			return yaml.Unmarshal(data, v)
+		}
+	default:
+		return nil, fmt.Errorf("libconfd: invalid http backend format %q", p.Format)
+	}
+
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	p.httpClient = &http.Client{Transport: transport}
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	return p, nil
+}
+
+func (p *HttpBackend) Close() error {
+	p.cancel()
+	err := p.getWatcher().Close()
+	p.httpClient.CloseIdleConnections()
+	return err
+}
+
+func (_ *HttpBackend) Type() string {
+	return HttpBackendType
+}
+
+func (_ *HttpBackend) WatchEnabled() bool {
+	return true
+}
+
+// GetValues fetches the documents, and returns the values of keys under keys.
+func (p *HttpBackend) GetValues(keys []string) (map[string]string, error) {
+	values, err := p.fetchAll(p.ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	vars := make(map[string]string)
+	for k, v := range values {
+		for _, prefix := range keys {
+			if KeyHasPrefix(k, prefix) {
+				vars[k] = v
+				break
+			}
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix waits until a key under keys is changed in any of the documents.
+func (p *HttpBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return p.getWatcher().WatchPrefix(prefix, keys, waitIndex, stopChan)
+}
+
+// WatchEvents sends the change events of keys under keys.
+func (p *HttpBackend) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error) {
+	return p.getWatcher().WatchEvents(ctx, prefix, keys, revision)
+}
+
+func (p *HttpBackend) getWatcher() *fileWatcher {
+	p.watcherOnce.Do(func() {
+		p.watcher = newFileWatcher(
+			func() (map[string]string, error) { return p.fetchAll(p.ctx, p.LongPollWait) },
+			nil,
+			p.PollInterval,
+		)
+	})
+	return p.watcher
+}
+
+// fetchAll fetches and merges the documents of all URLs.
+func (p *HttpBackend) fetchAll(ctx context.Context, wait time.Duration) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, u := range p.URLs {
+		values, err := p.fetch(ctx, u, wait)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// fetch returns the values of the document of url, the cached values
+// are returned if the document is not modified.
+//
+// If wait > 0 and the document is cached, the server is asked to hold
+// the response until the document is changed or wait elapses.
+func (p *HttpBackend) fetch(ctx context.Context, rawurl string, wait time.Duration) (map[string]string, error) {
+	cacheKey := rawurl
+
+	p.mu.Lock()
+	cached, hasCache := p.cache[cacheKey]
+	p.mu.Unlock()
+
+	if !hasCache || cached.etag == "" {
+		wait = 0
+	}
+
+	if wait > 0 && p.LongPollParam != "" {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set(p.LongPollParam, strconv.Itoa(int(wait/time.Second)))
+		u.RawQuery = q.Encode()
+		rawurl = u.String()
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Format == "yaml" {
+		req.Header.Set("Accept", "application/yaml, application/json")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	if hasCache && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if wait > 0 {
+		req.Header.Set("Prefer", "wait="+strconv.Itoa(int(wait/time.Second)))
+	}
+	switch {
+	case p.userName != "":
+		req.SetBasicAuth(p.userName, p.password)
+	case p.password != "":
+		req.Header.Set("Authorization", "Bearer "+p.password)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.RequestTimeout+wait)
+	defer cancel()
+
+	resp, err := p.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if hasCache {
+			return cached.values, nil
+		}
+		fallthrough
+	default:
+		return nil, fmt.Errorf("libconfd: GET %s: response status %s", rawurl, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := p.unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("libconfd: decode %s failed: %v", rawurl, err)
+	}
+
+	values := make(map[string]string)
+	if err := FlattenTree("", doc, values); err != nil {
+		return nil, fmt.Errorf("libconfd: decode %s failed: %v", rawurl, err)
+	}
+
+	// the root is not a valid key
+	delete(values, "")
+
+	p.mu.Lock()
+	p.cache[cacheKey] = httpDocument{etag: resp.Header.Get("ETag"), values: values}
+	p.mu.Unlock()
+
+	return values, nil
+}
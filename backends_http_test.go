@@ -0,0 +1,179 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tHttpDocument serves a document with ETag, and holds the conditional
+// requests with "Prefer: wait=N" until the document is changed.
+type tHttpDocument struct {
+	mu       sync.Mutex
+	body     string
+	version  int
+	changed  chan struct{}
+	requests int
+	modified int // responses with 200
+	query    string
+}
+
+func tNewHttpDocument(body string) *tHttpDocument {
+	return &tHttpDocument{body: body, version: 1, changed: make(chan struct{})}
+}
+
+func (p *tHttpDocument) Set(body string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.body = body
+	p.version++
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *tHttpDocument) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.requests++
+	p.query = r.URL.RawQuery
+	etag, changed := strconv.Quote(strconv.Itoa(p.version)), p.changed
+	p.mu.Unlock()
+
+	if r.Header.Get("If-None-Match") == etag {
+		if s := r.Header.Get("Prefer"); s != "" {
+			select {
+			case <-changed:
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	etag = strconv.Quote(strconv.Itoa(p.version))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	p.modified++
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(p.body))
+}
+
+func TestHttpBackend(t *testing.T) {
+	doc := tNewHttpDocument(`{"db": {"host": "127.0.0.1", "port": 3306}, "key": "foobar"}`)
+	server := httptest.NewServer(doc)
+	defer server.Close()
+
+	c := MustNewBackendClient(&BackendConfig{
+		Type: HttpBackendType,
+		Host: []string{server.URL},
+	})
+	defer c.Close()
+
+	expect := map[string]string{
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+	}
+	for i := 0; i < 2; i++ {
+		m, err := c.GetValues([]string{"/db"})
+		tAssert(t, err == nil, err)
+		tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
+	}
+
+	// not modified
+	tAssertf(t, doc.requests == 2 && doc.modified == 1, "requests = %d, modified = %d", doc.requests, doc.modified)
+
+	doc.Set("key: yaml")
+
+	c = MustNewBackendClient(&BackendConfig{
+		Type:    HttpBackendType,
+		Host:    []string{server.URL},
+		Options: map[string]string{"format": "yaml"},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues(nil)
+	tAssert(t, err == nil, err)
+	tAssert(t, reflect.DeepEqual(m, map[string]string{"/key": "yaml"}), m)
+}
+
+func TestHttpBackend_invalid(t *testing.T) {
+	for _, cfg := range []*BackendConfig{
+		{Type: HttpBackendType},
+		{Type: HttpBackendType, Host: []string{"http://a"}, Options: map[string]string{"format": "xml"}},
+		{Type: HttpBackendType, Host: []string{"http://a", "http://b"}, Options: map[string]string{"long_poll_wait": "1m"}},
+	} {
+		_, err := NewBackendClient(cfg)
+		tAssertf(t, err != nil, "expect error: %v", cfg)
+	}
+}
+
+func TestHttpBackend_WatchPrefix(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"poll_interval": "50ms"},
+		{"long_poll_wait": "10s", "long_poll_param": "wait"},
+	} {
+		doc := tNewHttpDocument(`{"a": "1", "b": "1"}`)
+		server := httptest.NewServer(doc)
+
+		c := MustNewBackendClient(&BackendConfig{
+			Type:    HttpBackendType,
+			Host:    []string{server.URL},
+			Options: options,
+		})
+
+		stopChan := make(chan bool)
+
+		index, err := c.WatchPrefix("/", []string{"/a"}, 0, stopChan)
+		tAssert(t, err == nil, err)
+
+		ch := make(chan uint64, 1)
+		go func() {
+			newIndex, err := c.WatchPrefix("/", []string{"/a"}, index, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- newIndex
+		}()
+
+		// other key
+		doc.Set(`{"a": "1", "b": "2"}`)
+		select {
+		case newIndex := <-ch:
+			t.Fatalf("%v: unexpected return: %d", options, newIndex)
+		case <-time.After(time.Second / 2):
+		}
+
+		doc.Set(`{"a": "2", "b": "2"}`)
+		select {
+		case newIndex := <-ch:
+			tAssertf(t, newIndex > index, "%v: index = %d, last = %d", options, newIndex, index)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: timeout", options)
+		}
+
+		if options["long_poll_wait"] != "" {
+			doc.mu.Lock()
+			query := doc.query
+			doc.mu.Unlock()
+			tAssert(t, query == "wait=10", query)
+		}
+
+		close(stopChan)
+		c.Close()
+		server.Close()
+	}
+}
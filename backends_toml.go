@@ -5,18 +5,41 @@
 package libconfd
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 const TomlBackendType = "libconfd-backend-toml"
 
-var _ BackendClient = (*TomlBackend)(nil)
+var (
+	_ BackendClient = (*TomlBackend)(nil)
+	_ EventWatcher  = (*TomlBackend)(nil)
+	_ BackendWriter = (*TomlBackend)(nil)
+)
 
 type TomlBackend struct {
 	TOMLFile string
+
+	skippedMutex sync.Mutex
+	skipped      []SkippedKey
+
+	writeMutex sync.Mutex
+
+	watcherOnce sync.Once
+	watcher     *fileWatcher
 }
 
 func init() {
@@ -34,8 +57,8 @@ func NewTomlBackendClient(cfg *BackendConfig) *TomlBackend {
 	return &TomlBackend{TOMLFile: cfg.Host[0]}
 }
 
-func (_ *TomlBackend) Close() error {
-	return nil
+func (p *TomlBackend) Close() error {
+	return p.getWatcher().Close()
 }
 
 func (_ *TomlBackend) Type() string {
@@ -43,27 +66,258 @@ func (_ *TomlBackend) Type() string {
 }
 
 func (_ *TomlBackend) WatchEnabled() bool {
-	return false
+	return true
+}
+
+// WatchPrefix waits until a key under keys is changed in the TOML file.
+// Writes, atomic renames and removes of the file are detected.
+func (p *TomlBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return p.getWatcher().WatchPrefix(prefix, keys, waitIndex, stopChan)
 }
 
-func (_ *TomlBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	return 0, fmt.Errorf("do not support watch")
+// WatchEvents sends the change events of keys under keys.
+func (p *TomlBackend) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error) {
+	return p.getWatcher().WatchEvents(ctx, prefix, keys, revision)
 }
 
+// GetValues reads all keys from the TOML file.
+//
+// Tables are flattened into slash paths, top level keys starting with
+// "/" are used as absolute paths. Integers, floats, booleans and datetimes
+// are converted to strings, array items are indexed by position or by their
+// name field. Keys which can not be converted are skipped, see SkippedKeys.
 func (p *TomlBackend) GetValues(keys []string) (m map[string]string, err error) {
-	var dataMap map[string]string
+	var dataMap map[string]interface{}
 	_, err = toml.DecodeFile(p.TOMLFile, &dataMap)
 	if err != nil {
 		return nil, err
 	}
 
-	// skip invalid key
+	var skipped []SkippedKey
 	m = make(map[string]string)
-	for k, v := range dataMap {
+
+	names := make([]string, 0, len(dataMap))
+	for k := range dataMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
 		if strings.HasPrefix(k, "/") {
+			flattenTomlValue(k, k, dataMap[k], m, &skipped)
+		} else {
+			flattenTomlValue(k, "/"+k, dataMap[k], m, &skipped)
+		}
+	}
+
+	// the file is reloaded on each change and poll, so the skipped keys
+	// are logged only when they are changed
+	p.skippedMutex.Lock()
+	if !reflect.DeepEqual(skipped, p.skipped) {
+		for _, x := range skipped {
+			GetLogger().Warningf("libconfd: %s: skip key %q: %s", p.TOMLFile, x.Key, x.Reason)
+		}
+	}
+	p.skipped = skipped
+	p.skippedMutex.Unlock()
+
+	return m, nil
+}
+
+// SetValues sets the values in the TOML file, the file is created if
+// not exists.
+//
+// Only the flat files of top level absolute keys with string values,
+// like "/db/host" = "127.0.0.1", are writable, the files with tables or
+// other value types are refused, since they can not be rewritten as is.
+// The comments of the file are not kept.
+func (p *TomlBackend) SetValues(ctx context.Context, values map[string]string) error {
+	for k := range values {
+		if !strings.HasPrefix(k, "/") || path.Clean(k) != k {
+			return fmt.Errorf("libconfd: invalid key path %q", k)
+		}
+	}
+	return p.update(func(m map[string]string) {
+		for k, v := range values {
 			m[k] = v
 		}
+	})
+}
+
+// DeleteKeys deletes the keys and the keys under them from the TOML file.
+// The file is rewritten like SetValues.
+func (p *TomlBackend) DeleteKeys(ctx context.Context, keys []string) error {
+	if err := ValidDeleteKeys(keys); err != nil {
+		return err
+	}
+	return p.update(func(m map[string]string) {
+		for k := range m {
+			for _, key := range keys {
+				if KeyHasPrefix(k, key) {
+					delete(m, k)
+					break
+				}
+			}
+		}
+	})
+}
+
+// update applies fn to the values of the TOML file, and replaces the
+// file atomically, so the watchers never read a partial file.
+func (p *TomlBackend) update(fn func(m map[string]string)) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	m, err := p.readFlatFile()
+	if err != nil {
+		return err
+	}
+
+	fn(m)
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(p.TOMLFile); err == nil {
+		mode = fi.Mode()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p.TOMLFile), "."+filepath.Base(p.TOMLFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p.TOMLFile)
+}
+
+// readFlatFile reads the values of the flat TOML file for update, it
+// fails if the file has other keys or values.
+func (p *TomlBackend) readFlatFile() (map[string]string, error) {
+	var dataMap map[string]interface{}
+	if _, err := toml.DecodeFile(p.TOMLFile, &dataMap); err != nil {
+		if os.IsNotExist(err) {
+			return make(map[string]string), nil
+		}
+		return nil, err
 	}
 
+	m := make(map[string]string)
+	for k, v := range dataMap {
+		s, ok := v.(string)
+		if !ok || !strings.HasPrefix(k, "/") || path.Clean(k) != k {
+			return nil, fmt.Errorf("libconfd: %s: can not rewrite key %q, only the flat files of absolute keys and string values are writable",
+				p.TOMLFile, k,
+			)
+		}
+		m[k] = s
+	}
 	return m, nil
 }
+
+// SkippedKey is a key skipped by the backend and the reason.
+type SkippedKey struct {
+	Key    string
+	Reason string
+}
+
+// SkippedKeys returns the keys skipped by the last GetValues.
+func (p *TomlBackend) SkippedKeys() []SkippedKey {
+	p.skippedMutex.Lock()
+	defer p.skippedMutex.Unlock()
+
+	return append([]SkippedKey{}, p.skipped...)
+}
+
+// flattenTomlValue flattens the decoded TOML value into vars,
+// name is the TOML key path used in skip reports.
+func flattenTomlValue(name, key string, val interface{}, vars map[string]string, skipped *[]SkippedKey) {
+	skip := func(format string, a ...interface{}) {
+		*skipped = append(*skipped, SkippedKey{Key: name, Reason: fmt.Sprintf(format, a...)})
+	}
+
+	switch val := val.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(val))
+		for k := range val {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		for _, k := range names {
+			if k == "" {
+				skip("empty key in table")
+				continue
+			}
+			flattenTomlValue(name+"."+k, strings.TrimSuffix(key, "/")+"/"+k, val[k], vars, skipped)
+		}
+		return
+	case []map[string]interface{}:
+		for i, item := range val {
+			flattenTomlValue(fmt.Sprintf("%s[%d]", name, i), strings.TrimSuffix(key, "/")+"/"+tomlArrayIndex(i, item), item, vars, skipped)
+		}
+		return
+	case []interface{}:
+		for i, item := range val {
+			m, _ := item.(map[string]interface{})
+			flattenTomlValue(fmt.Sprintf("%s[%d]", name, i), strings.TrimSuffix(key, "/")+"/"+tomlArrayIndex(i, m), item, vars, skipped)
+		}
+		return
+	}
+
+	if path.Clean(key) != key {
+		skip("invalid key path %q", key)
+		return
+	}
+	if _, exists := vars[key]; exists {
+		skip("duplicate key path %q", key)
+		return
+	}
+
+	switch val := val.(type) {
+	case string:
+		vars[key] = val
+	case bool:
+		vars[key] = strconv.FormatBool(val)
+	case int64:
+		vars[key] = strconv.FormatInt(val, 10)
+	case float64:
+		vars[key] = strconv.FormatFloat(val, 'f', -1, 64)
+	case time.Time:
+		vars[key] = val.Format(time.RFC3339Nano)
+	default:
+		skip("unsupported value type %T", val)
+	}
+}
+
+// tomlArrayIndex returns the name field of table item, or the index.
+func tomlArrayIndex(i int, item map[string]interface{}) string {
+	if name, ok := item["name"].(string); ok && name != "" {
+		return name
+	}
+	return strconv.Itoa(i)
+}
+
+func (p *TomlBackend) getWatcher() *fileWatcher {
+	p.watcherOnce.Do(func() {
+		p.watcher = newFileWatcher(
+			func() (map[string]string, error) { return p.GetValues(nil) },
+			func() []string { return fileDirs(p.TOMLFile) },
+			0,
+		)
+	})
+	return p.watcher
+}
@@ -5,7 +5,13 @@
 package libconfd
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestTomlBackend(t *testing.T) {
@@ -19,3 +25,265 @@ func TestTomlBackend(t *testing.T) {
 		t.Fatal(v)
 	}
 }
+
+func TestTomlBackend_WatchPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "backend.toml")
+	writeFile := func(content string) {
+		// atomic rename, like most editors
+		tmp := name + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(`"/a/x" = "1"` + "\n" + `"/b/x" = "1"`)
+
+	c := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/", []string{"/a"}, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tAssert(t, index > 0, index)
+
+	type result struct {
+		index uint64
+		err   error
+	}
+	watch := func(waitIndex uint64) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", []string{"/a"}, waitIndex, stopChan)
+			ch <- result{index, err}
+		}()
+		return ch
+	}
+
+	// change other key
+	ch := watch(index)
+	writeFile(`"/a/x" = "1"` + "\n" + `"/b/x" = "2"`)
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpected return: %v", r)
+	case <-time.After(time.Second / 2):
+	}
+
+	// change watched key
+	writeFile(`"/a/x" = "2"` + "\n" + `"/b/x" = "2"`)
+	select {
+	case r := <-ch:
+		tAssert(t, r.err == nil, r.err)
+		tAssertf(t, r.index > index, "index = %d, last = %d", r.index, index)
+		index = r.index
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// remove file, the last values are kept
+	ch = watch(index)
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpected return: %v", r)
+	case <-time.After(time.Second / 2):
+	}
+
+	// create it again with the same values
+	writeFile(`"/a/x" = "2"` + "\n" + `"/b/x" = "2"`)
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpected return: %v", r)
+	case <-time.After(time.Second / 2):
+	}
+
+	// change watched key
+	writeFile(`"/a/x" = "3"`)
+	select {
+	case r := <-ch:
+		tAssert(t, r.err == nil, r.err)
+		tAssertf(t, r.index > index, "index = %d, last = %d", r.index, index)
+		index = r.index
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+	select {
+	case r := <-ch:
+		tAssert(t, r.err == nil, r.err)
+		tAssert(t, r.index == index, r.index)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestTomlBackend_nested(t *testing.T) {
+	c := NewTomlBackendClient(&BackendConfig{
+		Type: TomlBackendType,
+		Host: []string{"./testdata/backend/nested.toml"},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/key":                "foobar",
+		"/name":               "app",
+		"/ports/0":            "80",
+		"/ports/1":            "443",
+		"/created":            "2018-01-02T03:04:05Z",
+		"/database/host":      "10.0.0.1",
+		"/database/port":      "3306",
+		"/database/enabled":   "true",
+		"/database/ratio":     "0.5",
+		"/upstream/app1/name": "app1",
+		"/upstream/app1/addr": "10.0.1.10:8080",
+		"/upstream/1/addr":    "10.0.1.11:8080",
+	}
+	tAssertf(t, reflect.DeepEqual(m, expect), "expect = %v, got = %v", expect, m)
+
+	skipped := c.SkippedKeys()
+	tAssertf(t, len(skipped) == 3, "skipped = %v", skipped)
+	for _, x := range skipped {
+		switch x.Key {
+		case "/invalid/", "database", "database.host":
+		default:
+			t.Fatalf("unexpected skipped key: %v", x)
+		}
+		tAssert(t, x.Reason != "")
+	}
+}
+
+func TestTomlBackend_SetValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// created if not exists
+	name := filepath.Join(dir, "backend.toml")
+	c := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}})
+	defer c.Close()
+
+	ctx := context.Background()
+	err = c.SetValues(ctx, map[string]string{
+		"/db":      "root",
+		"/db/host": "127.0.0.1",
+		"/dbx/x":   "1",
+	})
+	tAssert(t, err == nil, err)
+
+	err = c.DeleteKeys(ctx, []string{"/db"})
+	tAssert(t, err == nil, err)
+
+	// rm / would delete all keys
+	err = c.DeleteKeys(ctx, []string{"/"})
+	tAssert(t, err != nil)
+
+	m, err := c.GetValues(nil)
+	tAssert(t, err == nil, err)
+	tAssert(t, reflect.DeepEqual(m, map[string]string{"/dbx/x": "1"}), m)
+
+	err = c.SetValues(ctx, map[string]string{"/a/../b": "1"})
+	tAssert(t, err != nil)
+
+	// keys skipped by GetValues would be lost
+	tWriteFile(t, name, `"/invalid/" = "x"`+"\n"+`"/key" = "foobar"`)
+	err = c.SetValues(ctx, map[string]string{"/key": "x"})
+	tAssert(t, err != nil)
+
+	// the tables and value types of nested files would be lost
+	nested := "[db]\nport = 3306\n"
+	tWriteFile(t, name, nested)
+	err = c.SetValues(ctx, map[string]string{"/db/host": "x"})
+	tAssert(t, err != nil)
+	err = c.DeleteKeys(ctx, []string{"/db/port"})
+	tAssert(t, err != nil)
+
+	data, err := ioutil.ReadFile(name)
+	tAssert(t, err == nil, err)
+	tAssert(t, string(data) == nested, string(data))
+}
+
+func TestTomlBackend_WatchEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "backend.toml")
+	tWriteFile(t, name, `"/a/x" = "1"`+"\n"+`"/a/y" = "1"`+"\n"+`"/b/x" = "1"`)
+
+	c := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}})
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := c.WatchEvents(ctx, "/", []string{"/a"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nextBatch := func() EventBatch {
+		t.Helper()
+		select {
+		case batch, ok := <-ch:
+			tAssert(t, ok, "channel closed")
+			tAssert(t, batch.Err == nil, batch.Err)
+			return batch
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return EventBatch{}
+	}
+
+	batch := nextBatch()
+	tAssert(t, batch.Reset)
+	tAssertf(t, len(batch.Events) == 2, "%v", batch.Events)
+
+	tWriteFile(t, name, `"/a/x" = "2"`+"\n"+`"/b/x" = "2"`)
+
+	batch = nextBatch()
+	tAssert(t, !batch.Reset)
+	expect := []Event{
+		{Type: EventPut, Key: "/a/x", OldValue: "1", NewValue: "2", Revision: batch.Revision},
+		{Type: EventDelete, Key: "/a/y", OldValue: "1", Revision: batch.Revision},
+	}
+	tAssertf(t, reflect.DeepEqual(batch.Events, expect), "expect = %v, got = %v", expect, batch.Events)
+
+	// resume from the last revision
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err = c.WatchEvents(ctx, "/", []string{"/a"}, batch.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tWriteFile(t, name, `"/a/x" = "3"`)
+
+	batch = nextBatch()
+	tAssert(t, !batch.Reset)
+	tAssertf(t, len(batch.Events) == 1 && batch.Events[0].NewValue == "3", "%v", batch.Events)
+}
@@ -0,0 +1,369 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultWatcherPollInterval is used when filesystem notifications
+// are not available for the watched paths.
+const defaultWatcherPollInterval = time.Second
+
+// defaultWatcherMaxModIndex is the default max changed keys saved for
+// WatchPrefix, the older half is pruned when it is exceeded, and the
+// watches from the pruned indexes return at once.
+const defaultWatcherMaxModIndex = 4096
+
+var errWatcherClosed = errors.New("libconfd: watcher is closed")
+
+// fileWatcher implements WatchPrefix for backends whose key space is
+// loaded from local files.
+//
+// A single goroutine watches the directories returned by dirs, reloads
+// the key space on every filesystem event (or poll tick) and records the
+// index at which each key was last put or deleted. The index increases
+// monotonically, so WatchPrefix can return as soon as a key under one of
+// the requested keys changed after waitIndex, even if the change happened
+// between two WatchPrefix calls.
+type fileWatcher struct {
+	load         func() (map[string]string, error)
+	dirs         func() []string
+	pollInterval time.Duration
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	closeChan chan struct{}
+	doneChan  chan struct{}
+
+	mu          sync.Mutex
+	index       uint64
+	values      map[string]string
+	modIndex    map[string]uint64
+	maxModIndex int           // see defaultWatcherMaxModIndex
+	pruned      uint64        // the changes before are pruned
+	notify      chan struct{} // closed and replaced on every change
+}
+
+// newFileWatcher creates a fileWatcher.
+// If pollInterval is zero, the key space is only reloaded on filesystem
+// notifications. If dirs is nil, it is only reloaded by polling.
+func newFileWatcher(
+	load func() (map[string]string, error),
+	dirs func() []string,
+	pollInterval time.Duration,
+) *fileWatcher {
+	return &fileWatcher{
+		load:         load,
+		dirs:         dirs,
+		pollInterval: pollInterval,
+		closeChan:    make(chan struct{}),
+		doneChan:     make(chan struct{}),
+		index:        1,
+		modIndex:     make(map[string]uint64),
+		maxModIndex:  defaultWatcherMaxModIndex,
+		notify:       make(chan struct{}),
+	}
+}
+
+func (w *fileWatcher) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if w.isClosed() {
+		return waitIndex, errWatcherClosed
+	}
+	w.start()
+
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	for {
+		w.mu.Lock()
+		index, changed := w.changedSince(keys, waitIndex)
+		notify := w.notify
+		w.mu.Unlock()
+
+		// return something > 0 to trigger a key retrieval from the store
+		if waitIndex == 0 {
+			return index, nil
+		}
+		if changed {
+			return index, nil
+		}
+
+		select {
+		case <-notify:
+			// check again
+		case <-stopChan:
+			return waitIndex, nil
+		case <-w.closeChan:
+			return waitIndex, errWatcherClosed
+		}
+	}
+}
+
+// WatchEvents sends the changes of keys under keys after revision.
+//
+// The old values are not kept, so the first batch is a Reset batch
+// unless revision is the current index.
+func (w *fileWatcher) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan EventBatch, error) {
+	if w.isClosed() {
+		return nil, errWatcherClosed
+	}
+	w.start()
+
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	ch := make(chan EventBatch, 1)
+	send := func(batch EventBatch) bool {
+		select {
+		case ch <- batch:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	w.mu.Lock()
+	last, index, notify := w.valuesOf(keys), w.index, w.notify
+	w.mu.Unlock()
+
+	go func() {
+		defer close(ch)
+
+		if revision != index {
+			events := diffEvents(nil, last, index)
+			if !send(EventBatch{Events: events, Revision: index, Reset: true}) {
+				return
+			}
+		}
+
+		for {
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return
+			case <-w.closeChan:
+				send(EventBatch{Revision: index, Err: errWatcherClosed})
+				return
+			}
+
+			w.mu.Lock()
+			values := w.valuesOf(keys)
+			index, notify = w.index, w.notify
+			w.mu.Unlock()
+
+			events := diffEvents(last, values, index)
+			last = values
+
+			if len(events) > 0 {
+				if !send(EventBatch{Events: events, Revision: index}) {
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (w *fileWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closeChan)
+	})
+
+	// wait the watch goroutine if started
+	started := true
+	w.startOnce.Do(func() { started = false })
+	if started {
+		<-w.doneChan
+	}
+	return nil
+}
+
+func (w *fileWatcher) isClosed() bool {
+	select {
+	case <-w.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// start watches the dirs before the first load,
+// so no change is lost between them.
+func (w *fileWatcher) start() {
+	w.startOnce.Do(func() {
+		pollInterval := w.pollInterval
+
+		var watcher *fsnotify.Watcher
+		if w.dirs != nil {
+			var err error
+			if watcher, err = fsnotify.NewWatcher(); err != nil {
+				GetLogger().Warningf("libconfd: fsnotify unavailable, poll files instead: %v", err)
+				watcher = nil
+			}
+		}
+		if watcher == nil || !w.addWatchDirs(watcher) {
+			if pollInterval <= 0 {
+				pollInterval = defaultWatcherPollInterval
+			}
+		}
+
+		w.refresh()
+
+		// the dirs may be changed by the first load
+		if watcher != nil {
+			w.addWatchDirs(watcher)
+		}
+
+		go w.run(watcher, pollInterval)
+	})
+}
+
+func (w *fileWatcher) run(watcher *fsnotify.Watcher, pollInterval time.Duration) {
+	defer close(w.doneChan)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if watcher != nil {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	var tick <-chan time.Time
+	if pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.closeChan:
+			return
+		case ev := <-events:
+			GetLogger().Debugf("libconfd: file event %s", ev)
+			w.refresh()
+			w.addWatchDirs(watcher)
+		case err := <-errs:
+			GetLogger().Warning(err)
+		case <-tick:
+			w.refresh()
+		}
+	}
+}
+
+// addWatchDirs adds the dirs to watcher, it reports whether all dirs are watched.
+// Adding an already watched dir is a no-op.
+func (w *fileWatcher) addWatchDirs(watcher *fsnotify.Watcher) (ok bool) {
+	ok = true
+	for _, dir := range w.dirs() {
+		if err := watcher.Add(dir); err != nil {
+			GetLogger().Warningf("libconfd: watch %s failed: %v", dir, err)
+			ok = false
+		}
+	}
+	return
+}
+
+// refresh reloads the key space and records the changed keys.
+// A load error keeps the last values, since a missing or partly written
+// file is usually transient, e.g. while it is replaced.
+func (w *fileWatcher) refresh() {
+	values, err := w.load()
+	if err != nil {
+		GetLogger().Warningf("libconfd: reload failed, keep last values: %v", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var changedKeys []string
+	for k, v := range values {
+		if old, ok := w.values[k]; !ok || old != v {
+			changedKeys = append(changedKeys, k)
+		}
+	}
+	for k := range w.values {
+		if _, ok := values[k]; !ok {
+			changedKeys = append(changedKeys, k)
+		}
+	}
+	if len(changedKeys) == 0 {
+		return
+	}
+
+	w.index++
+	for _, k := range changedKeys {
+		w.modIndex[k] = w.index
+	}
+	w.values = values
+
+	if n := uint64(w.maxModIndex / 2); len(w.modIndex) > w.maxModIndex && w.index > n {
+		w.pruned = w.index - n
+		for k, idx := range w.modIndex {
+			if idx <= w.pruned {
+				delete(w.modIndex, k)
+			}
+		}
+	}
+
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// changedSince returns the current index, and reports whether any key
+// under keys changed after waitIndex. The caller must hold w.mu.
+func (w *fileWatcher) changedSince(keys []string, waitIndex uint64) (uint64, bool) {
+	if waitIndex < w.pruned {
+		return w.index, true
+	}
+	for k, idx := range w.modIndex {
+		if idx <= waitIndex {
+			continue
+		}
+		for _, prefix := range keys {
+			if KeyHasPrefix(k, prefix) {
+				return w.index, true
+			}
+		}
+	}
+	return w.index, false
+}
+
+// valuesOf returns the values of keys under keys. The caller must hold w.mu.
+func (w *fileWatcher) valuesOf(keys []string) map[string]string {
+	m := make(map[string]string)
+	for k, v := range w.values {
+		for _, prefix := range keys {
+			if KeyHasPrefix(k, prefix) {
+				m[k] = v
+				break
+			}
+		}
+	}
+	return m
+}
+
+// fileDirs returns the cleaned directories of names, without duplicates.
+func fileDirs(names ...string) []string {
+	var dirs []string
+	for _, name := range names {
+		dir := filepath.Dir(filepath.Clean(name))
+		if !strInStrList(dir, dirs) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
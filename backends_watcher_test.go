@@ -0,0 +1,111 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tFileLoader struct {
+	mu     sync.Mutex
+	values map[string]string
+	err    error
+}
+
+func (p *tFileLoader) load() (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	m := make(map[string]string)
+	for k, v := range p.values {
+		m[k] = v
+	}
+	return m, nil
+}
+
+func (p *tFileLoader) set(values map[string]string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.values, p.err = values, err
+}
+
+func TestFileWatcher_loadError(t *testing.T) {
+	loader := &tFileLoader{values: map[string]string{"/a/x": "1", "/b/x": "1"}}
+
+	w := newFileWatcher(loader.load, nil, time.Second/100)
+	defer w.Close()
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	index, err := w.WatchPrefix("/", []string{"/a"}, 0, stopChan)
+	tAssert(t, err == nil, err)
+
+	ch := make(chan uint64, 1)
+	go func() {
+		newIndex, _ := w.WatchPrefix("/", []string{"/a"}, index, stopChan)
+		ch <- newIndex
+	}()
+
+	// one of the files is missing
+	loader.set(nil, &os.PathError{Op: "open", Path: "b.toml", Err: os.ErrNotExist})
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(time.Second / 2):
+	}
+
+	w.mu.Lock()
+	values := w.valuesOf([]string{"/"})
+	w.mu.Unlock()
+	tAssert(t, len(values) == 2, values)
+
+	loader.set(map[string]string{"/a/x": "2", "/b/x": "1"}, nil)
+	select {
+	case newIndex := <-ch:
+		tAssertf(t, newIndex > index, "index = %d, last = %d", newIndex, index)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFileWatcher_pruned(t *testing.T) {
+	loader := &tFileLoader{values: map[string]string{}}
+
+	w := newFileWatcher(loader.load, nil, 0)
+	defer w.Close()
+	w.maxModIndex = 4
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	keys := []string{"/db"}
+
+	index, err := w.WatchPrefix("/", keys, 0, stopChan)
+	tAssert(t, err == nil, err)
+
+	// the removed keys are saved until pruned
+	for i := 0; i < 10; i++ {
+		loader.set(map[string]string{fmt.Sprintf("/tmp/%d", i): "1"}, nil)
+		w.refresh()
+	}
+
+	w.mu.Lock()
+	n := len(w.modIndex)
+	w.mu.Unlock()
+	tAssertf(t, n <= w.maxModIndex, "len(modIndex) = %d", n)
+
+	// the changes after index are pruned
+	newIndex, err := w.WatchPrefix("/", keys, index, stopChan)
+	tAssert(t, err == nil, err)
+	tAssertf(t, newIndex > index, "index = %d, last = %d", newIndex, index)
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"sort"
+	"time"
+)
+
+// CallStatus is the status of a Call.
+type CallStatus int
+
+const (
+	CallQueued   CallStatus = iota // waiting to run
+	CallRunning                    // running
+	CallDone                       // returned, or canceled while running, without error
+	CallFailed                     // returned with Call.Error
+	CallCanceled                   // canceled before running
+)
+
+func (s CallStatus) String() string {
+	switch s {
+	case CallQueued:
+		return "queued"
+	case CallRunning:
+		return "running"
+	case CallDone:
+		return "done"
+	case CallFailed:
+		return "failed"
+	case CallCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// TemplateResult is the result of the last run of a template resource.
+type TemplateResult struct {
+	Name     string // path of the template resource config
+	LastRun  time.Time
+	Duration time.Duration
+	Err      error
+	Runs     int // number of runs
+	Failures int // number of failed runs
+}
+
+// Cancel stops the call, a queued call is done without running.
+// It does not wait for the call to return, wait Done for the result.
+func (call *Call) Cancel() {
+	if call.cancel != nil {
+		call.cancel()
+	}
+}
+
+// Status returns the status of the call.
+func (call *Call) Status() CallStatus {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	return call.status
+}
+
+// StartTime returns the time the call started running, or the zero
+// time if it is queued.
+func (call *Call) StartTime() time.Time {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	return call.startTime
+}
+
+// FinishTime returns the time the call is done, or the zero time if it
+// is not done.
+func (call *Call) FinishTime() time.Time {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	return call.finishTime
+}
+
+// Results returns the results of the template resources which have
+// been run, sorted by name.
+func (call *Call) Results() []TemplateResult {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	results := make([]TemplateResult, 0, len(call.results))
+	for _, r := range call.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+func (call *Call) setRunning() {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	call.status = CallRunning
+	call.startTime = time.Now()
+}
+
+// finish sets the status by call.Error.
+func (call *Call) finish() {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	call.status = CallDone
+	if call.Error != nil {
+		call.status = CallFailed
+	}
+	call.finishTime = time.Now()
+}
+
+// finishCanceled sets the status of a call canceled before running,
+// the start time is not set.
+func (call *Call) finishCanceled() {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	call.status = CallCanceled
+	call.finishTime = time.Now()
+}
+
+func (call *Call) setResult(name string, start time.Time, err error) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	if call.results == nil {
+		call.results = make(map[string]TemplateResult)
+	}
+
+	r := call.results[name]
+	r.Name = name
+	r.LastRun = start
+	r.Duration = time.Since(start)
+	r.Err = err
+	r.Runs++
+	if err != nil {
+		r.Failures++
+	}
+	call.results[name] = r
+}
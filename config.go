@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -26,6 +27,15 @@ type Config struct {
 	// The backend polling interval in seconds. (10)
 	Interval int `toml:"interval" json:"interval"`
 
+	// The max random delay added to each polling interval in seconds. (0)
+	IntervalJitter int `toml:"interval_jitter" json:"interval_jitter"`
+
+	// The timeout of backend requests in seconds, 0 means the default. (30)
+	BackendTimeout int `toml:"backend_timeout" json:"backend_timeout"`
+
+	// The backend health check interval in seconds, 0 means the default. (30)
+	HealthCheckInterval int `toml:"health_check_interval" json:"health_check_interval"`
+
 	// Enable noop mode. Process all template resources; skip target update.
 	Noop bool `toml:"noop" json:"noop"`
 
@@ -45,6 +55,18 @@ type Config struct {
 	// enable watch support
 	Watch bool `toml:"watch" json:"watch"`
 
+	// The full resync interval of watch mode in seconds, 0 disables. (0)
+	ResyncInterval int `toml:"resync_interval" json:"resync_interval"`
+
+	// The quiet period of changes before rendering in watch mode in milliseconds. (0)
+	Debounce int `toml:"debounce" json:"debounce"`
+
+	// The minimum interval between two renders in watch mode in seconds. (0)
+	MinReloadInterval int `toml:"min_reload_interval" json:"min_reload_interval"`
+
+	// The max template resources processed at the same time, 0 means the default. (1)
+	Concurrency int `toml:"concurrency" json:"concurrency"`
+
 	// keep staged files
 	KeepStageFile bool `toml:"keep_stage_file" json:"keep_stage_file"`
 
@@ -60,6 +82,8 @@ type Config struct {
 	HookOnCheckCmdDone  func(trName, cmd string, err error)  `toml:"-" json:"-"`
 	HookOnReloadCmdDone func(trName, cmd string, err error)  `toml:"-" json:"-"`
 	HookOnUpdateDone    func(trName string, err error)       `toml:"-" json:"-"`
+	HookOnSnapshot      func(trName string, revision uint64) `toml:"-" json:"-"`
+	HookOnHealthChange  func(state HealthState, err error)   `toml:"-" json:"-"`
 }
 
 const defaultConfigContent = `
@@ -73,6 +97,15 @@ confdir = "confd"
 # The backend polling interval in seconds. (10)
 interval = 10
 
+# The max random delay added to each polling interval in seconds. (0)
+interval_jitter = 0
+
+# The timeout of backend requests in seconds, 0 means the default. (30)
+backend_timeout = 30
+
+# The backend health check interval in seconds, 0 means the default. (30)
+health_check_interval = 30
+
 # Enable noop mode. Process all template resources; skip target update.
 noop = false
 
@@ -91,6 +124,18 @@ onetime = true
 # enable watch support
 watch = false
 
+# The full resync interval of watch mode in seconds, 0 disables. (0)
+resync_interval = 0
+
+# The quiet period of changes before rendering in watch mode in milliseconds. (0)
+debounce = 0
+
+# The minimum interval between two renders in watch mode in seconds. (0)
+min_reload_interval = 0
+
+# The max template resources processed at the same time, 0 means the default. (1)
+concurrency = 1
+
 # the TOML backend file to watch for changes
 file = "./confd/backend-file.toml"
 
@@ -166,6 +211,27 @@ func (p *Config) Valid() error {
 	if p.Interval < 0 {
 		return fmt.Errorf("invalid Interval: %d", p.Interval)
 	}
+	if p.IntervalJitter < 0 {
+		return fmt.Errorf("invalid IntervalJitter: %d", p.IntervalJitter)
+	}
+	if p.ResyncInterval < 0 {
+		return fmt.Errorf("invalid ResyncInterval: %d", p.ResyncInterval)
+	}
+	if p.Debounce < 0 {
+		return fmt.Errorf("invalid Debounce: %d", p.Debounce)
+	}
+	if p.MinReloadInterval < 0 {
+		return fmt.Errorf("invalid MinReloadInterval: %d", p.MinReloadInterval)
+	}
+	if p.Concurrency < 0 {
+		return fmt.Errorf("invalid Concurrency: %d", p.Concurrency)
+	}
+	if p.BackendTimeout < 0 {
+		return fmt.Errorf("invalid BackendTimeout: %d", p.BackendTimeout)
+	}
+	if p.HealthCheckInterval < 0 {
+		return fmt.Errorf("invalid HealthCheckInterval: %d", p.HealthCheckInterval)
+	}
 	if p.LogLevel != "" && !newLogLevel(p.LogLevel).Valid() {
 		return fmt.Errorf("invalid LogLevel: %s", p.LogLevel)
 	}
@@ -205,6 +271,60 @@ func (p *Config) Clone() *Config {
 	return &q
 }
 
+// GetInterval returns the backend polling interval.
+func (p *Config) GetInterval() time.Duration {
+	if p.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(p.Interval) * time.Second
+}
+
+// GetIntervalJitter returns the max random delay of the polling interval.
+func (p *Config) GetIntervalJitter() time.Duration {
+	return time.Duration(p.IntervalJitter) * time.Second
+}
+
+// GetResyncInterval returns the full resync interval of watch mode,
+// 0 if it is disabled.
+func (p *Config) GetResyncInterval() time.Duration {
+	return time.Duration(p.ResyncInterval) * time.Second
+}
+
+// GetDebounce returns the quiet period of changes before rendering.
+func (p *Config) GetDebounce() time.Duration {
+	return time.Duration(p.Debounce) * time.Millisecond
+}
+
+// GetMinReloadInterval returns the minimum interval between two renders.
+func (p *Config) GetMinReloadInterval() time.Duration {
+	return time.Duration(p.MinReloadInterval) * time.Second
+}
+
+// GetConcurrency returns the max template resources processed at the
+// same time.
+func (p *Config) GetConcurrency() int {
+	if p.Concurrency <= 0 {
+		return 1
+	}
+	return p.Concurrency
+}
+
+// GetBackendTimeout returns the timeout of backend requests.
+func (p *Config) GetBackendTimeout() time.Duration {
+	if p.BackendTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(p.BackendTimeout) * time.Second
+}
+
+// GetHealthCheckInterval returns the interval of backend health checks.
+func (p *Config) GetHealthCheckInterval() time.Duration {
+	if p.HealthCheckInterval <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(p.HealthCheckInterval) * time.Second
+}
+
 func (p *Config) GetConfigDir() string {
 	return filepath.Join(p.ConfDir, "conf.d")
 }
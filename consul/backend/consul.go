@@ -0,0 +1,383 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+var (
+	_ libconfd.BackendClient   = (*ConsulClient)(nil)
+	_ libconfd.BackendClientV2 = (*ConsulClient)(nil)
+)
+
+const ConsulBackendType = "libconfd-backend-consul"
+
+func init() {
+	libconfd.RegisterBackendClient(
+		ConsulBackendType,
+		func(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error) {
+			return NewConsulClient(cfg)
+		},
+	)
+}
+
+// ConsulClient reads keys from the Consul KV HTTP API.
+//
+// The key /db/host is read from the Consul key db/host. WatchPrefix uses
+// blocking queries and returns the X-Consul-Index of the prefix.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["127.0.0.1:8500"]               # or URLs, tried in order
+//	password = ""                           # ACL token
+//	client_ca_keys/client_cert/client_key   # enable https
+//
+//	[options]
+//	datacenter = ""
+//	wait_time = "5m"                        # max wait of blocking queries
+type ConsulClient struct {
+	urls       []string
+	token      string
+	datacenter string
+	waitTime   time.Duration
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	current int
+
+	// the watched keys seen at each returned index of each watch,
+	// used to detect deleted keys, see consulMaxWatchStates.
+	watchMu   sync.Mutex
+	watchKeys map[string]map[uint64]map[string]bool
+
+	hookKeyAdjuster func(key string) (realKey string)
+}
+
+// the max saved key sets of each watch, the watches from an older index
+// return at once, since the deleted keys are unknown.
+const consulMaxWatchStates = 32
+
+// kvPair is the item of GET /v1/kv/<key>?recurse response.
+type kvPair struct {
+	Key         string
+	Value       []byte // base64 in JSON
+	ModifyIndex uint64
+}
+
+func NewConsulClient(cfg *libconfd.BackendConfig) (*ConsulClient, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("backend_consul: empty host")
+	}
+
+	waitTime, err := cfg.GetDurationOption("wait_time", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
+	var urls []string
+	for _, host := range cfg.Host {
+		if !strings.Contains(host, "://") {
+			host = scheme + "://" + host
+		}
+		urls = append(urls, strings.TrimSuffix(host, "/"))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	p := &ConsulClient{
+		urls:       urls,
+		token:      cfg.Password,
+		datacenter: cfg.GetOption("datacenter", ""),
+		waitTime:   waitTime,
+		httpClient: &http.Client{Transport: transport},
+
+		watchKeys: make(map[string]map[uint64]map[string]bool),
+
+		hookKeyAdjuster: cfg.HookKeyAdjuster,
+	}
+
+	return p, nil
+}
+
+func (c *ConsulClient) Type() string {
+	return ConsulBackendType
+}
+
+func (c *ConsulClient) WatchEnabled() bool {
+	return true
+}
+
+func (c *ConsulClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// GetValues queries consul for keys prefixed by keys.
+func (c *ConsulClient) GetValues(keys []string) (map[string]string, error) {
+	return c.GetValuesContext(context.Background(), keys)
+}
+
+// GetValuesContext queries consul for keys prefixed by keys.
+func (c *ConsulClient) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		if c.hookKeyAdjuster != nil {
+			key = c.hookKeyAdjuster(key)
+		}
+
+		pairs, _, err := c.list(ctx, key, 0)
+		if err != nil {
+			return vars, err
+		}
+		for _, kv := range pairs {
+			if strings.HasSuffix(kv.Key, "/") {
+				continue // folder
+			}
+			vars["/"+kv.Key] = string(kv.Value)
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix waits until a key under keys is changed.
+// The returned index is the X-Consul-Index of prefix.
+func (c *ConsulClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	index, err := c.Watch(ctx, prefix, keys, waitIndex)
+	if err != nil && ctx.Err() != nil {
+		return index, nil // stopped
+	}
+	return index, err
+}
+
+// Watch is like WatchPrefix, it returns ctx.Err() when ctx is done.
+func (c *ConsulClient) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if c.hookKeyAdjuster != nil {
+		prefix = c.hookKeyAdjuster(prefix)
+		keys = append([]string{}, keys...)
+		for i, key := range keys {
+			keys[i] = c.hookKeyAdjuster(key)
+		}
+	}
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	for {
+		pairs, index, err := c.list(ctx, prefix, waitIndex)
+		if err != nil {
+			if ctx.Err() != nil {
+				return waitIndex, ctx.Err()
+			}
+			return waitIndex, err
+		}
+
+		changed := c.updateWatchKeys(prefix, keys, pairs, waitIndex, index)
+
+		switch {
+		case waitIndex == 0:
+			// return something > 0 to trigger a key retrieval from the store
+			if index == 0 {
+				index = 1
+			}
+			return index, nil
+		case index < waitIndex:
+			// the index went backwards, the raft state is reset
+			return index, nil
+		case index > waitIndex && changed:
+			return index, nil
+		case index > waitIndex:
+			// changed keys are not watched
+			waitIndex = index
+		}
+	}
+}
+
+// updateWatchKeys saves the watched keys seen at index, and reports
+// whether any key under keys is modified or deleted after waitIndex.
+//
+// The keys are saved by the watch and the index, so each caller finds
+// the deleted keys from its own waitIndex.
+func (c *ConsulClient) updateWatchKeys(prefix string, keys []string, pairs []kvPair, waitIndex, index uint64) bool {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	watchKey := prefix + "\x00" + strings.Join(keys, "\x00")
+	states := c.watchKeys[watchKey]
+	if states == nil {
+		states = make(map[uint64]map[string]bool)
+		c.watchKeys[watchKey] = states
+	}
+	lastKeys, known := states[waitIndex]
+
+	isWatched := func(key string) bool {
+		for _, k := range keys {
+			if libconfd.KeyHasPrefix(key, k) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var changed bool
+	current := make(map[string]bool)
+	for _, kv := range pairs {
+		key := "/" + kv.Key
+		if !isWatched(key) {
+			continue
+		}
+		current[key] = true
+		if kv.ModifyIndex > waitIndex {
+			changed = true
+		}
+	}
+	for key := range lastKeys {
+		if !current[key] {
+			changed = true
+		}
+	}
+
+	// the keys at an unknown index may be deleted
+	if !known && waitIndex != 0 && index != waitIndex {
+		changed = true
+	}
+
+	states[index] = current
+	for len(states) > consulMaxWatchStates {
+		oldest := index
+		for idx := range states {
+			if idx < oldest {
+				oldest = idx
+			}
+		}
+		delete(states, oldest)
+	}
+	return changed
+}
+
+// list returns the pairs under key and the X-Consul-Index.
+// If waitIndex is not zero, it is a blocking query.
+func (c *ConsulClient) list(ctx context.Context, key string, waitIndex uint64) ([]kvPair, uint64, error) {
+	query := url.Values{}
+	query.Set("recurse", "true")
+	if c.datacenter != "" {
+		query.Set("dc", c.datacenter)
+	}
+	if waitIndex > 0 {
+		query.Set("index", strconv.FormatUint(waitIndex, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(c.waitTime/time.Second)))
+	}
+
+	baseURL := c.getURL()
+	path := "/v1/kv/" + strings.TrimPrefix(key, "/")
+
+	req, err := http.NewRequest("GET", baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.nextURL(baseURL, err)
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var index uint64
+	if s := resp.Header.Get("X-Consul-Index"); s != "" {
+		if index, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, 0, fmt.Errorf("backend_consul: invalid X-Consul-Index %q", s)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// OK
+	case http.StatusNotFound:
+		return nil, index, nil
+	default:
+		return nil, 0, fmt.Errorf("backend_consul: GET %s: %s: %s",
+			path, resp.Status, strings.TrimSpace(string(body)),
+		)
+	}
+
+	var pairs []kvPair
+	if err := json.Unmarshal(body, &pairs); err != nil {
+		return nil, 0, err
+	}
+
+	// recurse matches by string prefix, /db also matches /dbx
+	result := pairs[:0]
+	for _, kv := range pairs {
+		if libconfd.KeyHasPrefix("/"+kv.Key, key) {
+			result = append(result, kv)
+		}
+	}
+
+	return result, index, nil
+}
+
+func (c *ConsulClient) getURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.urls[c.current]
+}
+
+// nextURL switches to the next agent if current agent is still baseURL.
+func (c *ConsulClient) nextURL(baseURL string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.urls[c.current] != baseURL || len(c.urls) == 1 {
+		return
+	}
+
+	libconfd.GetLogger().Warningf("backend_consul: %s failed: %v", baseURL, err)
+	c.current = (c.current + 1) % len(c.urls)
+}
@@ -0,0 +1,318 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_consul
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+// tFakeConsul emulates the KV endpoints of Consul.
+type tFakeConsul struct {
+	token string
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	index  uint64
+	values map[string]kvPair
+}
+
+func tNewFakeConsul(token string) *tFakeConsul {
+	p := &tFakeConsul{
+		token:  token,
+		index:  1,
+		values: make(map[string]kvPair),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *tFakeConsul) Put(key, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.index++
+	p.values[key] = kvPair{Key: key, Value: []byte(value), ModifyIndex: p.index}
+	p.cond.Broadcast()
+}
+
+func (p *tFakeConsul) Delete(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.index++
+	delete(p.values, key)
+	p.cond.Broadcast()
+}
+
+func (p *tFakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != p.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// blocking query, wait until the index is changed
+	if waitIndex > 0 && waitIndex >= p.index {
+		timer := time.AfterFunc(wait, func() {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+		defer timer.Stop()
+
+		deadline := time.Now().Add(wait)
+		for waitIndex >= p.index && time.Now().Before(deadline) {
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+			p.cond.Wait()
+		}
+	}
+
+	var pairs []kvPair
+	for k, kv := range p.values {
+		if strings.HasPrefix(k, prefix) {
+			pairs = append(pairs, kv)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(p.index, 10))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConsulClient_GetValues(t *testing.T) {
+	consul := tNewFakeConsul("secret")
+	consul.Put("db/host", "127.0.0.1")
+	consul.Put("db/port", "3306")
+	consul.Put("dbx/host", "skip")
+	consul.Put("db/", "")
+
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     ConsulBackendType,
+		Host:     []string{strings.TrimPrefix(server.URL, "http://")},
+		Password: "secret",
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	// bad token
+	c = libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: ConsulBackendType,
+		Host: []string{server.URL},
+	})
+	defer c.Close()
+
+	if _, err := c.GetValues([]string{"/db"}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestConsulClient_tls(t *testing.T) {
+	consul := tNewFakeConsul("")
+	consul.Put("key", "foobar")
+
+	server := httptest.NewTLSServer(consul)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:         ConsulBackendType,
+		Host:         []string{strings.TrimPrefix(server.URL, "https://")},
+		ClientCAKeys: caFile,
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["/key"] != "foobar" {
+		t.Fatal(m)
+	}
+}
+
+func TestConsulClient_WatchPrefix(t *testing.T) {
+	consul := tNewFakeConsul("")
+	consul.Put("db/host", "127.0.0.1")
+
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:    ConsulBackendType,
+		Host:    []string{server.URL},
+		Options: map[string]string{"wait_time": "1s"},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	keys := []string{"/db/host"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(waitIndex uint64) chan uint64 {
+		ch := make(chan uint64, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", keys, waitIndex, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- index
+		}()
+		return ch
+	}
+	expectWakeup := func(ch chan uint64) {
+		t.Helper()
+		select {
+		case newIndex := <-ch:
+			if newIndex <= index {
+				t.Fatalf("index = %d, last = %d", newIndex, index)
+			}
+			index = newIndex
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// other key, and blocking query timeout
+	ch := watch(index)
+	consul.Put("db/port", "3306")
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	consul.Put("db/host", "10.0.0.1")
+	expectWakeup(ch)
+
+	// delete
+	ch = watch(index)
+	consul.Delete("db/host")
+	expectWakeup(ch)
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+	select {
+	case newIndex := <-ch:
+		if newIndex != index {
+			t.Fatalf("index = %d, last = %d", newIndex, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestConsulClient_WatchPrefix_sharedKeys(t *testing.T) {
+	consul := tNewFakeConsul("")
+	consul.Put("db/host", "127.0.0.1")
+
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:    ConsulBackendType,
+		Host:    []string{server.URL},
+		Options: map[string]string{"wait_time": "1s"},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	keys := []string{"/db/host"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two templates watch the same keys from the same index
+	ch := make(chan uint64, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			newIndex, err := c.WatchPrefix("/", keys, index, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- newIndex
+		}()
+	}
+
+	time.Sleep(time.Second / 10)
+	consul.Delete("db/host")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case newIndex := <-ch:
+			if newIndex <= index {
+				t.Fatalf("index = %d, last = %d", newIndex, index)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout: deletion missed")
+		}
+	}
+}
@@ -8,22 +8,41 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io/ioutil"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 
 	"openpitrix.io/libconfd"
 )
 
 var (
-	_ libconfd.BackendClient = (*_EtcdClient)(nil)
+	_ libconfd.BackendClient   = (*_EtcdClient)(nil)
+	_ libconfd.BackendClientV2 = (*_EtcdClient)(nil)
+	_ libconfd.EventWatcher    = (*_EtcdClient)(nil)
+	_ libconfd.SnapshotReader  = (*_EtcdClient)(nil)
+	_ libconfd.HealthChecker   = (*_EtcdClient)(nil)
+	_ libconfd.KeyAdjuster     = (*_EtcdClient)(nil)
 )
 
+// default timeout of each request if the context has no deadline
+const defaultRequestTimeout = 3 * time.Second
+
+// default max idle clients in the pool
+const defaultPoolSize = 8
+
+// max operations in a txn, the default limit of etcd server
+const maxTxnOps = 128
+
 const Etcdv3BackendType = "libconfd-backend-etcdv3"
 
+var errClosed = errors.New("backend_etcdv3: client is closed")
+
 func init() {
 	libconfd.RegisterBackendClient(
 		Etcdv3BackendType,
@@ -33,21 +52,56 @@ func init() {
 	)
 }
 
+// _EtcdClient reads keys from etcd v3.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["127.0.0.1:2379"]
+//	user/password                           # etcd auth
+//	client_ca_keys/client_cert/client_key   # enable https
+//
+//	[options]
+//	dial_timeout = "5s"
+//	dial_keepalive_time = "10s"
+//	dial_keepalive_timeout = "3s"
+//	request_timeout = "3s"                  # used if the context has no deadline
+//	auto_sync_interval = "0s"               # sync the endpoints with the cluster members, 0 disables
+//	max_call_send_msg_size = 0              # bytes, 0 is the grpc default 2MB
+//	max_call_recv_msg_size = 0              # bytes, 0 is math.MaxInt32
+//	namespace = ""                          # prefix prepended to all keys
+//	pool_size = 8                           # max idle clients
 type _EtcdClient struct {
-	cfg clientv3.Config
+	cfg            clientv3.Config
+	namespace      string
+	requestTimeout time.Duration
 
 	clientPoolMutex sync.Mutex
 	clientPool      []*clientv3.Client
+	poolSize        int
+
+	// long-lived client and watches, shared by all watch calls
+	watchMutex sync.Mutex
+	watchCli   *clientv3.Client
+	watchers   map[string]*prefixWatcher
+	closed     bool
 
 	hookKeyAdjuster func(key string) (realKey string)
 }
 
 func NewEtcdClient(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error) {
+	opts, err := getEtcdOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	etcdConfig := clientv3.Config{
 		Endpoints:            cfg.Host,
-		DialTimeout:          5 * time.Second,
-		DialKeepAliveTime:    10 * time.Second,
-		DialKeepAliveTimeout: 3 * time.Second,
+		AutoSyncInterval:     opts.autoSyncInterval,
+		DialTimeout:          opts.dialTimeout,
+		DialKeepAliveTime:    opts.dialKeepAliveTime,
+		DialKeepAliveTimeout: opts.dialKeepAliveTimeout,
+		MaxCallSendMsgSize:   opts.maxCallSendMsgSize,
+		MaxCallRecvMsgSize:   opts.maxCallRecvMsgSize,
 	}
 
 	etcdConfig.Username = cfg.UserName
@@ -88,6 +142,10 @@ func NewEtcdClient(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error)
 
 	p := &_EtcdClient{
 		cfg:             etcdConfig,
+		namespace:       opts.namespace,
+		requestTimeout:  opts.requestTimeout,
+		poolSize:        opts.poolSize,
+		watchers:        make(map[string]*prefixWatcher),
 		hookKeyAdjuster: cfg.HookKeyAdjuster,
 	}
 
@@ -95,10 +153,25 @@ func NewEtcdClient(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error)
 }
 
 func (c *_EtcdClient) Close() error {
+	var lastErr error
+
+	c.watchMutex.Lock()
+	c.closed = true
+	for prefix, w := range c.watchers {
+		w.Close()
+		delete(c.watchers, prefix)
+	}
+	if c.watchCli != nil {
+		if err := c.watchCli.Close(); err != nil {
+			lastErr = err
+		}
+		c.watchCli = nil
+	}
+	c.watchMutex.Unlock()
+
 	c.clientPoolMutex.Lock()
 	defer c.clientPoolMutex.Unlock()
 
-	var lastErr error
 	for _, client := range c.clientPool {
 		if err := client.Close(); err != nil {
 			lastErr = err
@@ -122,11 +195,22 @@ func (c *_EtcdClient) getEtcdClient() (*clientv3.Client, error) {
 		return x, nil
 	}
 
+	return c.newClient()
+}
+
+// newClient creates a client, the keys are prefixed by the namespace.
+func (c *_EtcdClient) newClient() (*clientv3.Client, error) {
 	client, err := clientv3.New(c.cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.namespace != "" {
+		client.KV = namespace.NewKV(client.KV, c.namespace)
+		client.Watcher = namespace.NewWatcher(client.Watcher, c.namespace)
+		client.Lease = namespace.NewLease(client.Lease, c.namespace)
+	}
+
 	return client, nil
 }
 
@@ -135,7 +219,7 @@ func (c *_EtcdClient) putEtcdClient(x *clientv3.Client) {
 	defer c.clientPoolMutex.Unlock()
 
 	// close client
-	if len(c.clientPool) > 8 {
+	if len(c.clientPool) >= c.poolSize {
 		x.Close()
 		return
 	}
@@ -144,6 +228,52 @@ func (c *_EtcdClient) putEtcdClient(x *clientv3.Client) {
 	c.clientPool = append(c.clientPool, x)
 }
 
+// getWatchClient returns the shared client of watches.
+func (c *_EtcdClient) getWatchClient() (*clientv3.Client, error) {
+	c.watchMutex.Lock()
+	defer c.watchMutex.Unlock()
+
+	return c.getWatchClientLocked()
+}
+
+func (c *_EtcdClient) getWatchClientLocked() (*clientv3.Client, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	if c.watchCli == nil {
+		client, err := c.newClient()
+		if err != nil {
+			return nil, err
+		}
+		c.watchCli = client
+	}
+	return c.watchCli, nil
+}
+
+// getPrefixWatcher returns the watcher of prefix, a new watcher watches
+// the changes after revision.
+func (c *_EtcdClient) getPrefixWatcher(prefix string, revision uint64) (*prefixWatcher, error) {
+	c.watchMutex.Lock()
+	defer c.watchMutex.Unlock()
+
+	if w, ok := c.watchers[prefix]; ok {
+		return w, nil
+	}
+
+	client, err := c.getWatchClientLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newPrefixWatcher(client, prefix, revision, c.requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.watchers[prefix] = w
+	return w, nil
+}
+
 func (c *_EtcdClient) Type() string {
 	return Etcdv3BackendType
 }
@@ -152,108 +282,320 @@ func (c *_EtcdClient) WatchEnabled() bool {
 	return true
 }
 
-// GetValues queries etcd for keys prefixed by prefix.
-func (c *_EtcdClient) GetValues(keys []string) (map[string]string, error) {
-	if c.hookKeyAdjuster != nil {
-		return c.getValues_hookKeyAdjuster(keys)
-	}
-
-	vars := make(map[string]string)
-
+// HealthCheck gets the status of the endpoints, it succeeds if any
+// endpoint responds.
+func (c *_EtcdClient) HealthCheck(ctx context.Context) error {
 	client, err := c.getEtcdClient()
 	if err != nil {
-		return vars, err
+		return err
 	}
 	defer c.putEtcdClient(client)
 
-	for _, key := range keys {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3)*time.Second)
-		resp, err := client.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
-		cancel()
-		if err != nil {
-			return vars, err
-		}
-		for _, ev := range resp.Kvs {
-			vars[string(ev.Key)] = string(ev.Value)
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	err = errors.New("backend_etcdv3: no endpoint")
+	for _, endpoint := range client.Endpoints() {
+		if _, err = client.Status(ctx, endpoint); err == nil {
+			return nil
 		}
 	}
-	return vars, nil
+	return err
+}
+
+// GetValues queries etcd for keys prefixed by prefix.
+func (c *_EtcdClient) GetValues(keys []string) (map[string]string, error) {
+	return c.GetValuesContext(context.Background(), keys)
 }
 
-func (c *_EtcdClient) getValues_hookKeyAdjuster(_keys []string) (map[string]string, error) {
-	var realKeysMap = map[string]string{}
-	for _, key := range _keys {
-		readKey := c.hookKeyAdjuster(key)
-		realKeysMap[readKey] = key
+// GetValuesContext queries etcd for keys prefixed by prefix.
+// If ctx has no deadline, the request times out after the request_timeout option.
+func (c *_EtcdClient) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
+	vars, _, err := c.GetSnapshot(ctx, keys)
+	return vars, err
+}
+
+// GetSnapshot queries etcd for keys prefixed by prefix, and returns
+// the values with the revision they are read at.
+//
+// All prefixes are read in one transaction, or at the revision of the
+// first transaction if there are more than maxTxnOps prefixes.
+func (c *_EtcdClient) GetSnapshot(ctx context.Context, keys []string) (map[string]string, uint64, error) {
+	if c.hookKeyAdjuster != nil {
+		var realKeys []string
+		for _, key := range keys {
+			realKeys = append(realKeys, c.hookKeyAdjuster(key))
+		}
+		keys = realKeys
 	}
 
 	vars := make(map[string]string)
 
 	client, err := c.getEtcdClient()
 	if err != nil {
-		return vars, err
+		return vars, 0, err
 	}
 	defer c.putEtcdClient(client)
 
-	for key := range realKeysMap {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3)*time.Second)
-		resp, err := client.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
-		cancel()
-		if err != nil {
-			return vars, err
-		}
-		for _, ev := range resp.Kvs {
-			vars[string(ev.Key)] = string(ev.Value)
-		}
+	kvs, revision, err := rangeKeys(ctx, client, keys, c.requestTimeout)
+	if err != nil {
+		return vars, 0, err
+	}
+	for _, kv := range kvs {
+		vars[string(kv.Key)] = string(kv.Value)
 	}
-	return vars, nil
+	return vars, revision, nil
 }
 
 func (c *_EtcdClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	var err error
-	var logger = libconfd.GetLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	index, err := c.Watch(ctx, prefix, keys, waitIndex)
+	if err != nil && ctx.Err() != nil {
+		return index, nil // stopped
+	}
+	return index, err
+}
+
+// Watch waits until a key under keys is changed after waitIndex, and
+// returns the cluster revision. It returns ctx.Err() when ctx is done.
+//
+// A single watch of prefix is shared by all calls, so no change is lost
+// between two calls.
+func (c *_EtcdClient) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if c.hookKeyAdjuster != nil {
+		prefix = c.hookKeyAdjuster(prefix)
+		var realKeys []string
+		for _, key := range keys {
+			realKeys = append(realKeys, c.hookKeyAdjuster(key))
+		}
+		keys = realKeys
+	}
+
+	w, err := c.getPrefixWatcher(prefix, waitIndex)
+	if err != nil {
+		return waitIndex, err
+	}
 
 	// return something > 0 to trigger a key retrieval from the store
 	if waitIndex == 0 {
-		return 1, err
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if w.revision == 0 {
+			return 1, nil
+		}
+		return w.revision, nil
 	}
 
-	client, err := clientv3.New(c.cfg)
+	return w.Wait(ctx, keys, waitIndex)
+}
+
+// WatchEvents streams the events of keys under keys after revision.
+// If revision is 0 or compacted, a Reset batch of the current values
+// is sent first.
+func (c *_EtcdClient) WatchEvents(ctx context.Context, prefix string, keys []string, revision uint64) (<-chan libconfd.EventBatch, error) {
+	if c.hookKeyAdjuster != nil {
+		prefix = c.hookKeyAdjuster(prefix)
+		var realKeys []string
+		for _, key := range keys {
+			realKeys = append(realKeys, c.hookKeyAdjuster(key))
+		}
+		keys = realKeys
+	}
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	client, err := c.getWatchClient()
 	if err != nil {
-		return 1, err
+		return nil, err
 	}
-	defer client.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cancelRoutine := make(chan bool)
-	defer close(cancelRoutine)
+	ch := make(chan libconfd.EventBatch, 1)
+	send := func(batch libconfd.EventBatch) bool {
+		select {
+		case ch <- batch:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
 	go func() {
-		select {
-		case <-stopChan:
-			cancel()
-		case <-cancelRoutine:
-			return
+		defer close(ch)
+
+		for {
+			if revision == 0 {
+				events, rev, err := c.getSnapshot(ctx, client, keys)
+				if err != nil {
+					send(libconfd.EventBatch{Err: err})
+					return
+				}
+				if !send(libconfd.EventBatch{Events: events, Revision: rev, Reset: true}) {
+					return
+				}
+				revision = rev
+			}
+
+			var compacted bool
+			revision, compacted = c.watchEvents(ctx, client, prefix, keys, revision, send)
+			if !compacted {
+				return
+			}
+
+			libconfd.GetLogger().Warningf("backend_etcdv3: revision %d is compacted, resync", revision)
+			revision = 0
 		}
 	}()
 
-	rch := client.Watch(ctx, prefix, clientv3.WithPrefix())
+	return ch, nil
+}
+
+// watchEvents sends the events after revision until ctx is done or an error occurs,
+// it returns the last revision, and reports whether the revision is compacted.
+func (c *_EtcdClient) watchEvents(
+	ctx context.Context, client *clientv3.Client,
+	prefix string, keys []string, revision uint64,
+	send func(libconfd.EventBatch) bool,
+) (lastRevision uint64, compacted bool) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	rch := client.Watch(ctx, prefix,
+		clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithRev(int64(revision)+1),
+	)
 
 	for wresp := range rch {
+		if wresp.CompactRevision != 0 {
+			return revision, true
+		}
+		if err := wresp.Err(); err != nil {
+			send(libconfd.EventBatch{Revision: revision, Err: err})
+			return revision, false
+		}
+
+		var events []libconfd.Event
 		for _, ev := range wresp.Events {
-			logger.Debugf("Key updated %s", string(ev.Kv.Key))
-
-			// Only return if we have a key prefix we care about.
-			// This is not an exact match on the key so there is a chance
-			// we will still pickup on false positives. The net win here
-			// is reducing the scope of keys that can trigger updates.
-			for _, k := range keys {
-				if strings.HasPrefix(string(ev.Kv.Key), k) {
-					return uint64(ev.Kv.Version), err
-				}
+			key := string(ev.Kv.Key)
+			if !keyHasAnyPrefix(key, keys) {
+				continue
+			}
+
+			e := libconfd.Event{
+				Type:     libconfd.EventPut,
+				Key:      key,
+				NewValue: string(ev.Kv.Value),
+				Revision: uint64(ev.Kv.ModRevision),
+			}
+			if ev.Type == mvccpb.DELETE {
+				e.Type = libconfd.EventDelete
+				e.NewValue = ""
+			}
+			if ev.PrevKv != nil {
+				e.OldValue = string(ev.PrevKv.Value)
 			}
+			events = append(events, e)
 		}
+
+		revision = uint64(wresp.Header.Revision)
+		if len(events) > 0 {
+			if !send(libconfd.EventBatch{Events: events, Revision: revision}) {
+				return revision, false
+			}
+		}
+	}
+
+	if ctx.Err() == nil {
+		send(libconfd.EventBatch{Revision: revision, Err: errWatchClosed})
+	}
+	return revision, false
+}
+
+// getSnapshot returns the values of keys as EventPut events, all keys are
+// read at the same revision.
+func (c *_EtcdClient) getSnapshot(ctx context.Context, client *clientv3.Client, keys []string) ([]libconfd.Event, uint64, error) {
+	kvs, revision, err := rangeKeys(ctx, client, keys, c.requestTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var events []libconfd.Event
+	for _, kv := range kvs {
+		events = append(events, libconfd.Event{
+			Type:     libconfd.EventPut,
+			Key:      string(kv.Key),
+			NewValue: string(kv.Value),
+			Revision: uint64(kv.ModRevision),
+		})
+	}
+	return events, revision, nil
+}
+
+// rangeKeys reads the keys prefixed by keys at the same revision, and
+// returns the key-values sorted by key and the revision.
+//
+// The prefixes are read in transactions of at most maxTxnOps ranges,
+// the later transactions are pinned to the revision of the first one.
+// If ctx has no deadline, each transaction times out after timeout.
+func rangeKeys(ctx context.Context, client *clientv3.Client, keys []string, timeout time.Duration) ([]*mvccpb.KeyValue, uint64, error) {
+	_, hasDeadline := ctx.Deadline()
+
+	var revision int64
+	kvMap := make(map[string]*mvccpb.KeyValue)
+
+	for len(keys) > 0 || revision == 0 {
+		n := len(keys)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+
+		var ops []clientv3.Op
+		for _, key := range keys[:n] {
+			opts := []clientv3.OpOption{clientv3.WithPrefix()}
+			if revision > 0 {
+				opts = append(opts, clientv3.WithRev(revision))
+			}
+			ops = append(ops, clientv3.OpGet(key, opts...))
+		}
+		keys = keys[n:]
+
+		txnCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !hasDeadline {
+			txnCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		resp, err := client.Txn(txnCtx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				kvMap[string(kv.Key)] = kv
+			}
+		}
+	}
+
+	kvs := make([]*mvccpb.KeyValue, 0, len(kvMap))
+	for _, kv := range kvMap {
+		kvs = append(kvs, kv)
 	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
 
-	return 0, err
+	return kvs, uint64(revision), nil
 }
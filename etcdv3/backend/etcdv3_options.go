@@ -0,0 +1,71 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_etcdv3
+
+import (
+	"fmt"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+// etcdOptions is the options of BackendConfig.Options, see _EtcdClient.
+type etcdOptions struct {
+	dialTimeout          time.Duration
+	dialKeepAliveTime    time.Duration
+	dialKeepAliveTimeout time.Duration
+	requestTimeout       time.Duration
+	autoSyncInterval     time.Duration
+	maxCallSendMsgSize   int
+	maxCallRecvMsgSize   int
+	namespace            string
+	poolSize             int
+}
+
+func getEtcdOptions(cfg *libconfd.BackendConfig) (opts etcdOptions, err error) {
+	durations := []struct {
+		name         string
+		p            *time.Duration
+		defaultValue time.Duration
+	}{
+		{"dial_timeout", &opts.dialTimeout, 5 * time.Second},
+		{"dial_keepalive_time", &opts.dialKeepAliveTime, 10 * time.Second},
+		{"dial_keepalive_timeout", &opts.dialKeepAliveTimeout, 3 * time.Second},
+		{"request_timeout", &opts.requestTimeout, defaultRequestTimeout},
+		{"auto_sync_interval", &opts.autoSyncInterval, 0},
+	}
+	for _, v := range durations {
+		if *v.p, err = cfg.GetDurationOption(v.name, v.defaultValue); err != nil {
+			return opts, err
+		}
+		if *v.p < 0 {
+			return opts, fmt.Errorf("backend_etcdv3: invalid option %s = %v", v.name, *v.p)
+		}
+	}
+	if opts.requestTimeout == 0 {
+		return opts, fmt.Errorf("backend_etcdv3: invalid option request_timeout = 0")
+	}
+
+	ints := []struct {
+		name         string
+		p            *int
+		defaultValue int
+	}{
+		{"max_call_send_msg_size", &opts.maxCallSendMsgSize, 0},
+		{"max_call_recv_msg_size", &opts.maxCallRecvMsgSize, 0},
+		{"pool_size", &opts.poolSize, defaultPoolSize},
+	}
+	for _, v := range ints {
+		if *v.p, err = cfg.GetIntOption(v.name, v.defaultValue); err != nil {
+			return opts, err
+		}
+		if *v.p < 0 {
+			return opts, fmt.Errorf("backend_etcdv3: invalid option %s = %d", v.name, *v.p)
+		}
+	}
+
+	opts.namespace = cfg.GetOption("namespace", "")
+	return opts, nil
+}
@@ -0,0 +1,588 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_etcdv3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+
+	"openpitrix.io/libconfd"
+)
+
+// tEtcd is an embedded single node etcd server.
+type tEtcd struct {
+	dir    string
+	etcd   *embed.Etcd
+	client *clientv3.Client
+}
+
+func tStartEtcd(tb testing.TB) *tEtcd {
+	tb.Helper()
+
+	dir, err := ioutil.TempDir("", "libconfd-etcd")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	clientURL := tFreeURL(tb)
+	peerURL := tFreeURL(tb)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	cfg.LogPkgLevels = "*=ERROR"
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		tb.Fatal("etcd start timeout")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		e.Close()
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+
+	return &tEtcd{dir: dir, etcd: e, client: client}
+}
+
+func tFreeURL(tb testing.TB) url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	return url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func (p *tEtcd) Endpoint() string {
+	return p.etcd.Config().ACUrls[0].String()
+}
+
+func (p *tEtcd) Put(tb testing.TB, key, value string) int64 {
+	tb.Helper()
+
+	resp, err := p.client.Put(context.Background(), key, value)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return resp.Header.Revision
+}
+
+func (p *tEtcd) Delete(tb testing.TB, key string) int64 {
+	tb.Helper()
+
+	resp, err := p.client.Delete(context.Background(), key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return resp.Header.Revision
+}
+
+func (p *tEtcd) Close() {
+	p.client.Close()
+	p.etcd.Close()
+	os.RemoveAll(p.dir)
+}
+
+func TestEtcdClient_GetValues(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	etcd.Put(t, "/db/host", "127.0.0.1")
+	etcd.Put(t, "/db/port", "3306")
+	etcd.Put(t, "/key", "foobar")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	if err := c.(libconfd.HealthChecker).HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEtcdClient_options(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	etcd.Put(t, "/db/host", "127.0.0.1")
+	etcd.Put(t, "/ns/db/host", "10.0.0.1")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+		Options: map[string]string{
+			"dial_timeout":       "1s",
+			"request_timeout":    "1s",
+			"auto_sync_interval": "1m",
+			"namespace":          "/ns",
+			"pool_size":          "0",
+		},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"/db/host": "10.0.0.1"}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	for _, options := range []map[string]string{
+		{"request_timeout": "0s"},
+		{"dial_timeout": "abc"},
+		{"pool_size": "-1"},
+	} {
+		_, err := NewEtcdClient(&libconfd.BackendConfig{
+			Type:    Etcdv3BackendType,
+			Host:    []string{etcd.Endpoint()},
+			Options: options,
+		})
+		if err == nil {
+			t.Fatalf("expect error: %v", options)
+		}
+	}
+}
+
+func TestEtcdClient_GetSnapshot(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	// more prefixes than a txn
+	var keys []string
+	for i := 0; i < maxTxnOps+10; i++ {
+		keys = append(keys, fmt.Sprintf("/app/%03d", i))
+	}
+	for _, key := range keys {
+		etcd.Put(t, key, key)
+	}
+	rev := etcd.Put(t, "/app/000", "last")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c.Close()
+
+	m, revision, err := c.(libconfd.SnapshotReader).GetSnapshot(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != uint64(rev) {
+		t.Fatalf("revision = %d, expect = %d", revision, rev)
+	}
+	if len(m) != len(keys) || m["/app/000"] != "last" || m["/app/137"] != "/app/137" {
+		t.Fatalf("unexpected values: %v", m)
+	}
+}
+
+func TestEtcdClient_SetValues(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	etcd.Put(t, "/dbx/host", "10.0.0.1")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c.Close()
+
+	w, err := libconfd.ToBackendWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	err = w.SetValues(ctx, map[string]string{
+		"/db":      "root",
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+		"/key":     "foobar",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.DeleteKeys(ctx, []string{"/db", "/key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// rm / would delete the whole keyspace
+	for _, keys := range [][]string{nil, {"/"}, {""}, {"/db", "/"}} {
+		if err := w.DeleteKeys(ctx, keys); err == nil {
+			t.Fatalf("expect error of keys %q", keys)
+		}
+	}
+	hooked, err := NewEtcdClient(&libconfd.BackendConfig{
+		Type:            Etcdv3BackendType,
+		Host:            []string{etcd.Endpoint()},
+		HookKeyAdjuster: func(key string) string { return "/" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hooked.Close()
+	if err := hooked.(libconfd.BackendWriter).DeleteKeys(ctx, []string{"/app"}); err == nil {
+		t.Fatal("expect error of key adjusted to the root")
+	}
+	if m, _ := c.GetValues([]string{"/dbx"}); len(m) != 1 {
+		t.Fatalf("unexpected values: %v", m)
+	}
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"/dbx/host": "10.0.0.1"}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	// more keys than a txn can not be put atomically
+	values := make(map[string]string)
+	for i := 0; i < maxTxnOps+1; i++ {
+		values[fmt.Sprintf("/app/%03d", i)] = "1"
+	}
+	if err := w.SetValues(ctx, values); err == nil {
+		t.Fatal("expect error")
+	}
+	if m, _ := c.GetValues([]string{"/app"}); len(m) != 0 {
+		t.Fatalf("unexpected values: %v", m)
+	}
+}
+
+func TestEtcdClient_CompareAndSwap(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c.Close()
+
+	w := c.(libconfd.BackendCASWriter)
+	ctx := context.Background()
+
+	// create
+	index, err := w.CompareAndSwap(ctx, "/key", "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.CompareAndSwap(ctx, "/key", "x", 0); err != libconfd.ErrCompareFailed {
+		t.Fatalf("expect ErrCompareFailed, got = %v", err)
+	}
+
+	value, modIndex, err := w.GetIndex(ctx, "/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "1" || modIndex != index {
+		t.Fatalf("value = %q, index = %d, expect = %d", value, modIndex, index)
+	}
+
+	// changed by others
+	etcd.Put(t, "/key", "2")
+	if _, err := w.CompareAndSwap(ctx, "/key", "x", index); err != libconfd.ErrCompareFailed {
+		t.Fatalf("expect ErrCompareFailed, got = %v", err)
+	}
+	if err := w.CompareAndDelete(ctx, "/key", index); err != libconfd.ErrCompareFailed {
+		t.Fatalf("expect ErrCompareFailed, got = %v", err)
+	}
+
+	value, index, err = w.GetIndex(ctx, "/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "2" {
+		t.Fatalf("value = %q", value)
+	}
+	if err := w.CompareAndDelete(ctx, "/key", index); err != nil {
+		t.Fatal(err)
+	}
+	if _, index, _ := w.GetIndex(ctx, "/key"); index != 0 {
+		t.Fatalf("key is not deleted, index = %d", index)
+	}
+}
+
+func TestEtcdClient_WatchEvents(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	etcd.Put(t, "/db/host", "127.0.0.1")
+	etcd.Put(t, "/key", "foobar")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c.Close()
+
+	w := c.(libconfd.EventWatcher)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := w.WatchEvents(ctx, "/", []string{"/db"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nextBatch := func() libconfd.EventBatch {
+		t.Helper()
+		select {
+		case batch, ok := <-ch:
+			if !ok {
+				t.Fatal("channel closed")
+			}
+			if batch.Err != nil {
+				t.Fatal(batch.Err)
+			}
+			return batch
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return libconfd.EventBatch{}
+	}
+
+	batch := nextBatch()
+	if !batch.Reset || len(batch.Events) != 1 || batch.Events[0].NewValue != "127.0.0.1" {
+		t.Fatalf("unexpected batch: %v", batch)
+	}
+
+	etcd.Put(t, "/key", "skip")
+	rev := etcd.Put(t, "/db/host", "10.0.0.1")
+
+	batch = nextBatch()
+	expect := []libconfd.Event{{
+		Type: libconfd.EventPut, Key: "/db/host",
+		OldValue: "127.0.0.1", NewValue: "10.0.0.1", Revision: uint64(rev),
+	}}
+	if !reflect.DeepEqual(batch.Events, expect) || batch.Revision != uint64(rev) {
+		t.Fatalf("expect = %v, got = %v", expect, batch)
+	}
+
+	// resume after the revision, the changes between are not lost
+	cancel()
+	rev = etcd.Delete(t, "/db/host")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err = w.WatchEvents(ctx, "/", []string{"/db"}, batch.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch = nextBatch()
+	expect = []libconfd.Event{{
+		Type: libconfd.EventDelete, Key: "/db/host",
+		OldValue: "10.0.0.1", Revision: uint64(rev),
+	}}
+	if batch.Reset || !reflect.DeepEqual(batch.Events, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, batch)
+	}
+
+	// compacted revision, resync
+	cancel()
+	etcd.Put(t, "/db/host", "10.0.0.2")
+	rev = etcd.Put(t, "/key", "foobar")
+	if _, err := etcd.client.Compact(context.Background(), rev); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err = w.WatchEvents(ctx, "/", []string{"/db"}, batch.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch = nextBatch()
+	if !batch.Reset || len(batch.Events) != 1 || batch.Events[0].NewValue != "10.0.0.2" {
+		t.Fatalf("unexpected batch: %v", batch)
+	}
+}
+
+func TestEtcdClient_WatchPrefix(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	firstRev := etcd.Put(t, "/db/host", "127.0.0.1")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	keys := []string{"/db"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != uint64(firstRev) {
+		t.Fatalf("index = %d, expect = %d", index, firstRev)
+	}
+
+	watch := func(waitIndex uint64) chan uint64 {
+		ch := make(chan uint64, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", keys, waitIndex, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- index
+		}()
+		return ch
+	}
+	expectIndex := func(ch chan uint64, rev int64) {
+		t.Helper()
+		select {
+		case newIndex := <-ch:
+			if newIndex != uint64(rev) {
+				t.Fatalf("index = %d, expect = %d", newIndex, rev)
+			}
+			index = newIndex
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// changed before the watch call
+	rev := etcd.Put(t, "/db/host", "10.0.0.1")
+	time.Sleep(time.Second / 10)
+	expectIndex(watch(index), rev)
+
+	// other key
+	ch := watch(index)
+	etcd.Put(t, "/key", "foobar")
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(time.Second / 2):
+	}
+
+	rev = etcd.Delete(t, "/db/host")
+	expectIndex(ch, rev)
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+	expectIndex(ch, int64(index))
+
+	// resume from a compacted revision
+	rev = etcd.Put(t, "/db/host", "10.0.0.2")
+	if _, err := etcd.client.Compact(context.Background(), rev); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: Etcdv3BackendType,
+		Host: []string{etcd.Endpoint()},
+	})
+	defer c2.Close()
+
+	newIndex, err := c2.WatchPrefix("/", keys, uint64(firstRev), make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newIndex <= uint64(firstRev) {
+		t.Fatalf("index = %d, last = %d", newIndex, firstRev)
+	}
+}
+
+func TestPrefixWatcher_pruned(t *testing.T) {
+	etcd := tStartEtcd(t)
+	defer etcd.Close()
+
+	rev := etcd.Put(t, "/db/host", "127.0.0.1")
+
+	w, err := newPrefixWatcher(etcd.client, "/", uint64(rev), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.mu.Lock()
+	w.maxModRevision = 4
+	w.mu.Unlock()
+
+	for i := 0; i < 10; i++ {
+		rev = etcd.Put(t, fmt.Sprintf("/tmp/%d", i), "1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// wait all changes
+	index, err := w.Wait(ctx, []string{"/tmp/9"}, uint64(rev-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.mu.Lock()
+	n := len(w.modRevision)
+	w.mu.Unlock()
+	if n > w.maxModRevision {
+		t.Fatalf("len(modRevision) = %d", n)
+	}
+
+	// the changes of /db after the first revision are pruned
+	newIndex, err := w.Wait(ctx, []string{"/db"}, uint64(rev-9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newIndex != index {
+		t.Fatalf("index = %d, expect = %d", newIndex, index)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_etcdv3
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"openpitrix.io/libconfd"
+)
+
+var errWatchClosed = errors.New("backend_etcdv3: watch channel closed")
+
+// the default max changed keys saved for WatchPrefix, the older half is
+// pruned when it is exceeded, and the watches from the pruned revisions
+// return at once, since their changes are unknown.
+const defaultMaxModRevision = 4096
+
+// prefixWatcher keeps a single etcd watch of a prefix, shared by all
+// WatchPrefix calls of the prefix.
+//
+// It records the revision at which each key was last modified, so a
+// WatchPrefix call can return as soon as a key under its keys changed
+// after waitIndex, even if the change happened between two calls.
+// The broken watch is resumed from the last seen revision + 1, and a
+// compaction resets all keys at the current revision.
+type prefixWatcher struct {
+	client *clientv3.Client
+	prefix string
+
+	cancel   context.CancelFunc
+	doneChan chan struct{}
+
+	mu             sync.Mutex
+	startRevision  uint64            // changes before it are unknown
+	revision       uint64            // last seen cluster revision
+	resetRevision  uint64            // all keys are changed at it
+	modRevision    map[string]uint64 // key => revision of last change
+	maxModRevision int               // see defaultMaxModRevision
+	pruned         uint64            // the changes before are pruned
+	err            error             // error of the last broken watch
+	notify         chan struct{}     // closed and replaced on every change
+}
+
+// newPrefixWatcher watches prefix after revision, or after the current
+// revision if it is 0, which is read with the timeout.
+func newPrefixWatcher(client *clientv3.Client, prefix string, revision uint64, timeout time.Duration) (*prefixWatcher, error) {
+	if revision == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		revision = uint64(resp.Header.Revision)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &prefixWatcher{
+		client:         client,
+		prefix:         prefix,
+		cancel:         cancel,
+		doneChan:       make(chan struct{}),
+		startRevision:  revision,
+		revision:       revision,
+		modRevision:    make(map[string]uint64),
+		maxModRevision: defaultMaxModRevision,
+		notify:         make(chan struct{}),
+	}
+
+	go w.run(ctx)
+	return w, nil
+}
+
+func (w *prefixWatcher) Close() {
+	w.cancel()
+	<-w.doneChan
+}
+
+// Wait waits until a key under keys is changed after waitIndex, and
+// returns the cluster revision.
+func (w *prefixWatcher) Wait(ctx context.Context, keys []string, waitIndex uint64) (uint64, error) {
+	if len(keys) == 0 {
+		keys = []string{w.prefix}
+	}
+
+	w.mu.Lock()
+	lastErr := w.err
+	w.mu.Unlock()
+
+	for {
+		w.mu.Lock()
+		revision, changed := w.changedSince(keys, waitIndex)
+		err, notify := w.err, w.notify
+		w.mu.Unlock()
+
+		if changed {
+			return revision, nil
+		}
+		if err != nil && err != lastErr {
+			return waitIndex, err
+		}
+
+		select {
+		case <-notify:
+			// check again
+		case <-ctx.Done():
+			return waitIndex, ctx.Err()
+		case <-w.doneChan:
+			return waitIndex, errClosed
+		}
+	}
+}
+
+// changedSince returns the revision, and reports whether any key under
+// keys changed after waitIndex. The caller must hold w.mu.
+func (w *prefixWatcher) changedSince(keys []string, waitIndex uint64) (uint64, bool) {
+	if waitIndex < w.startRevision || waitIndex < w.resetRevision || waitIndex < w.pruned {
+		return w.revision, true
+	}
+	if waitIndex > w.revision {
+		// index of another cluster or watcher, the changes are unknown
+		return w.revision, true
+	}
+	for k, rev := range w.modRevision {
+		if rev > waitIndex && keyHasAnyPrefix(k, keys) {
+			return w.revision, true
+		}
+	}
+	return w.revision, false
+}
+
+func (w *prefixWatcher) run(ctx context.Context) {
+	defer close(w.doneChan)
+
+	for {
+		w.mu.Lock()
+		revision := w.revision
+		w.mu.Unlock()
+
+		err := w.watch(ctx, revision)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue // compacted, resumed from the compact revision
+		}
+
+		libconfd.GetLogger().Warningf("backend_etcdv3: watch %s broken, resume from %d: %v",
+			w.prefix, revision+1, err,
+		)
+
+		w.mu.Lock()
+		w.err = err
+		w.broadcast()
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// watch watches the prefix after revision until the watch is broken.
+func (w *prefixWatcher) watch(ctx context.Context, revision uint64) error {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	rch := w.client.Watch(ctx, w.prefix,
+		clientv3.WithPrefix(), clientv3.WithRev(int64(revision)+1),
+	)
+
+	for wresp := range rch {
+		if wresp.CompactRevision != 0 {
+			w.reset(uint64(wresp.CompactRevision))
+			return nil
+		}
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+
+		w.mu.Lock()
+		for _, ev := range wresp.Events {
+			libconfd.GetLogger().Debugf("Key updated %s", string(ev.Kv.Key))
+			w.modRevision[string(ev.Kv.Key)] = uint64(ev.Kv.ModRevision)
+		}
+		if rev := uint64(wresp.Header.Revision); rev > w.revision {
+			w.revision = rev
+		}
+		w.prune()
+		w.err = nil
+		if len(wresp.Events) > 0 {
+			w.broadcast()
+		}
+		w.mu.Unlock()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errWatchClosed
+}
+
+// reset marks all keys changed before the compact revision,
+// the watch resumes from the compact revision.
+func (w *prefixWatcher) reset(compactRevision uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	libconfd.GetLogger().Warningf("backend_etcdv3: revision %d of %s is compacted, resync",
+		w.revision+1, w.prefix,
+	)
+
+	if compactRevision-1 > w.revision {
+		w.revision = compactRevision - 1
+	}
+	w.resetRevision = w.revision
+	w.modRevision = make(map[string]uint64)
+	w.broadcast()
+}
+
+// prune removes the older half of the changed keys if there are too
+// many of them. The caller must hold w.mu.
+func (w *prefixWatcher) prune() {
+	n := uint64(w.maxModRevision / 2)
+	if len(w.modRevision) <= w.maxModRevision || w.revision <= n {
+		return
+	}
+	w.pruned = w.revision - n
+	for k, rev := range w.modRevision {
+		if rev <= w.pruned {
+			delete(w.modRevision, k)
+		}
+	}
+}
+
+// broadcast wakes up all waiters. The caller must hold w.mu.
+func (w *prefixWatcher) broadcast() {
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+func keyHasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_etcdv3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"openpitrix.io/libconfd"
+)
+
+var _ libconfd.BackendCASWriter = (*_EtcdClient)(nil)
+
+// SetValues puts the values in one transaction, it fails if there are
+// more than maxTxnOps keys, since they can not be put atomically.
+func (c *_EtcdClient) SetValues(ctx context.Context, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ops []clientv3.Op
+	for _, k := range keys {
+		ops = append(ops, clientv3.OpPut(c.AdjustKey(k), values[k]))
+	}
+	return c.commitOps(ctx, ops)
+}
+
+// DeleteKeys deletes the keys and the keys under them in one transaction,
+// "/db" deletes "/db" and "/db/host", but not "/dbx". Each key takes two
+// operations of maxTxnOps. The root key is refused, and so is a key
+// adjusted to the root, see libconfd.ValidDeleteKeys.
+func (c *_EtcdClient) DeleteKeys(ctx context.Context, keys []string) error {
+	if err := libconfd.ValidDeleteKeys(keys); err != nil {
+		return err
+	}
+
+	var ops []clientv3.Op
+	for _, k := range keys {
+		key := strings.TrimSuffix(c.AdjustKey(k), "/")
+		if key == "" {
+			return fmt.Errorf("backend_etcdv3: refuse to delete key %q, it is adjusted to the root", k)
+		}
+		ops = append(ops, clientv3.OpDelete(key))
+		ops = append(ops, clientv3.OpDelete(key+"/", clientv3.WithPrefix()))
+	}
+	return c.commitOps(ctx, ops)
+}
+
+// GetIndex returns the value of key and its mod revision.
+func (c *_EtcdClient) GetIndex(ctx context.Context, key string) (string, uint64, error) {
+	client, err := c.getEtcdClient()
+	if err != nil {
+		return "", 0, err
+	}
+	defer c.putEtcdClient(client)
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := client.Get(ctx, c.AdjustKey(key))
+	if err != nil {
+		return "", 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", 0, nil
+	}
+	return string(resp.Kvs[0].Value), uint64(resp.Kvs[0].ModRevision), nil
+}
+
+// CompareAndSwap puts key if its mod revision is prevIndex, and returns
+// the revision of the put.
+func (c *_EtcdClient) CompareAndSwap(ctx context.Context, key, value string, prevIndex uint64) (uint64, error) {
+	key = c.AdjustKey(key)
+	resp, err := c.commitIf(ctx,
+		clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex)),
+		clientv3.OpPut(key, value),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(resp.Header.Revision), nil
+}
+
+// CompareAndDelete deletes key if its mod revision is prevIndex.
+func (c *_EtcdClient) CompareAndDelete(ctx context.Context, key string, prevIndex uint64) error {
+	key = c.AdjustKey(key)
+	_, err := c.commitIf(ctx,
+		clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex)),
+		clientv3.OpDelete(key),
+	)
+	return err
+}
+
+// commitOps commits ops in one transaction of at most maxTxnOps operations.
+func (c *_EtcdClient) commitOps(ctx context.Context, ops []clientv3.Op) error {
+	if len(ops) > maxTxnOps {
+		return fmt.Errorf("backend_etcdv3: too many operations in one transaction: %d > %d",
+			len(ops), maxTxnOps,
+		)
+	}
+
+	client, err := c.getEtcdClient()
+	if err != nil {
+		return err
+	}
+	defer c.putEtcdClient(client)
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	_, err = client.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// commitIf commits op if cmp is true, or returns libconfd.ErrCompareFailed.
+func (c *_EtcdClient) commitIf(ctx context.Context, cmp clientv3.Cmp, op clientv3.Op) (*clientv3.TxnResponse, error) {
+	client, err := c.getEtcdClient()
+	if err != nil {
+		return nil, err
+	}
+	defer c.putEtcdClient(client)
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := client.Txn(ctx).If(cmp).Then(op).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, libconfd.ErrCompareFailed
+	}
+	return resp, nil
+}
+
+// withTimeout returns ctx with the request timeout if ctx has no deadline.
+func (c *_EtcdClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.requestTimeout)
+}
+
+// AdjustKey returns the key used in etcd, see libconfd.KeyAdjuster.
+func (c *_EtcdClient) AdjustKey(key string) string {
+	if c.hookKeyAdjuster != nil {
+		return c.hookKeyAdjuster(key)
+	}
+	return key
+}
@@ -28,6 +28,8 @@ EXAMPLE:
    miniconfd info
    miniconfd make target
    miniconfd getv key
+   miniconfd setv key value
+   miniconfd rm key
    miniconfd tour
 
    miniconfd run`
@@ -116,6 +118,58 @@ EXAMPLE:
 			},
 		},
 
+		{
+			Name:      "setv",
+			Usage:     "set values of keys to backend",
+			ArgsUsage: "key value [key value...]",
+
+			Action: func(c *cli.Context) {
+				args := c.Args()
+				if len(args) == 0 || len(args)%2 != 0 {
+					fmt.Fprintln(c.App.Writer, "setv: need key value pairs")
+					os.Exit(1)
+				}
+
+				values := make(map[string]string)
+				for i := 0; i < len(args); i += 2 {
+					values[args[i]] = args[i+1]
+				}
+
+				cfg := libconfd.MustLoadConfig(c.GlobalString("config"))
+
+				backendConfig := libconfd.MustLoadBackendConfig(c.GlobalString("backend-config"))
+				backendClient := libconfd.MustNewBackendClient(backendConfig)
+
+				libconfd.NewApplication(cfg, backendClient).SetValues(values)
+				return
+			},
+		},
+
+		{
+			Name:      "rm",
+			Usage:     "delete keys and the keys under them from backend",
+			ArgsUsage: "key...",
+
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					fmt.Fprintln(c.App.Writer, "rm: need keys")
+					os.Exit(1)
+				}
+				if err := libconfd.ValidDeleteKeys(c.Args()); err != nil {
+					fmt.Fprintln(c.App.Writer, "rm:", err)
+					os.Exit(1)
+				}
+
+				cfg := libconfd.MustLoadConfig(c.GlobalString("config"))
+
+				backendConfig := libconfd.MustLoadBackendConfig(c.GlobalString("backend-config"))
+				backendClient := libconfd.MustNewBackendClient(backendConfig)
+
+				libconfd.NewApplication(cfg, backendClient).DeleteKeys(c.Args()...)
+				return
+			},
+		},
+
 		{
 			Name:  "tour",
 			Usage: "show more examples",
@@ -182,6 +236,10 @@ miniconfd getv /
 miniconfd getv /key
 miniconfd getv / /key
 
+miniconfd setv /key value
+miniconfd setv /db/host 127.0.0.1 /db/port 3306
+miniconfd rm /db
+
 miniconfd run
 miniconfd run -once
 miniconfd run -noop
@@ -24,8 +24,9 @@ func (p KVPair) String() string {
 // A KVStore represents an in-memory key-value store safe for
 // concurrent access.
 type KVStore struct {
-	mu sync.RWMutex
-	m  map[string]KVPair
+	mu       sync.RWMutex
+	m        map[string]KVPair
+	revision uint64 // backend revision of the values
 }
 
 // New creates and initializes a new KVStore.
@@ -189,6 +190,35 @@ func (s *KVStore) Purge() {
 	for k := range s.m {
 		delete(s.m, k)
 	}
+	s.revision = 0
+}
+
+// values returns a copy of the values of all keys.
+func (s *KVStore) values() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m := make(map[string]string, len(s.m))
+	for k, kv := range s.m {
+		m[k] = kv.Value
+	}
+	return m
+}
+
+// Revision returns the backend revision of the values, or 0 if unknown.
+func (s *KVStore) Revision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.revision
+}
+
+// SetRevision sets the backend revision of the values.
+func (s *KVStore) SetRevision(revision uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revision = revision
 }
 
 func (_ *KVStore) stripKey(key, prefix string) string {
@@ -11,18 +11,18 @@
 package backend_metad
 
 import (
+	"bytes"
 	"container/ring"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -30,8 +30,10 @@ import (
 )
 
 var (
-	_      libconfd.BackendClient = (*MetadClient)(nil)
-	logger                        = libconfd.GetLogger()
+	_      libconfd.BackendClient   = (*MetadClient)(nil)
+	_      libconfd.BackendClientV2 = (*MetadClient)(nil)
+	_      libconfd.BackendWriter   = (*MetadClient)(nil)
+	logger                          = libconfd.GetLogger()
 )
 
 const MetadBackendType = "libconfd-backend-metad"
@@ -40,12 +42,40 @@ func init() {
 	libconfd.RegisterBackendClient(
 		MetadBackendType,
 		func(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error) {
-			return NewMetadClient(cfg.Host)
+			return NewMetadClientWithConfig(cfg)
 		},
 	)
 }
 
+// MetadClient reads keys from metad.
+//
+// The connections of hosts form a ring, the client switches to the next
+// available connection after max_errors failed requests.
+//
+// SetValues and DeleteKeys use the manage API of metad, they fail if
+// manage_url is not set.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["127.0.0.1:9611"]               # or URLs
+//	client_ca_keys/client_cert/client_key   # enable https
+//
+//	[options]
+//	request_timeout = "10s"                 # used if the context has no deadline, not for watch
+//	retry_backoff = "1s"                    # first backoff of selecting a connection
+//	retry_max_backoff = "15s"               # give up selecting when the backoff reaches it
+//	max_errors = 3                          # switch connection after max errors
+//	manage_url = ""                         # e.g. "http://127.0.0.1:9611"
 type MetadClient struct {
+	requestTimeout  time.Duration
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	maxErrors       uint32
+
+	manageURL    string
+	manageClient *http.Client
+
+	mu          sync.Mutex
 	connections *ring.Ring
 	current     *MetadConnection
 }
@@ -53,20 +83,97 @@ type MetadClient struct {
 type MetadConnection struct {
 	url        string
 	httpClient *http.Client
-	waitIndex  uint64
-	errTimes   uint32
+	waitIndex  uint64 // atomic
+	errTimes   uint32 // atomic
+}
+
+// RequestError is the error of a metad request.
+type RequestError struct {
+	Method     string // "GET" if empty
+	URL        string
+	StatusCode int    // 0 if no response
+	RequestID  string // X-Metad-RequestID header
+	Err        error  // nil if StatusCode is not 0
+}
+
+func (e *RequestError) Error() string {
+	method := e.Method
+	if method == "" {
+		method = "GET"
+	}
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("backend_metad: %s %s: response status %d, request id %q",
+			method, e.URL, e.StatusCode, e.RequestID,
+		)
+	}
+	return fmt.Sprintf("backend_metad: %s %s: %v", method, e.URL, e.Err)
 }
 
 func (c *MetadClient) Type() string       { return MetadBackendType }
 func (c *MetadClient) WatchEnabled() bool { return true }
-func (c *MetadClient) Close() error       { return nil }
+
+// Close closes the idle connections.
+func (c *MetadClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connections.Do(func(v interface{}) {
+		v.(*MetadConnection).httpClient.CloseIdleConnections()
+	})
+	c.manageClient.CloseIdleConnections()
+	return nil
+}
 
 func NewMetadClient(backendNodes []string) (*MetadClient, error) {
-	connections := ring.New(len(backendNodes))
-	for _, backendNode := range backendNodes {
-		url := "http://" + backendNode
+	return NewMetadClientWithConfig(&libconfd.BackendConfig{
+		Type: MetadBackendType,
+		Host: backendNodes,
+	})
+}
+
+func NewMetadClientWithConfig(cfg *libconfd.BackendConfig) (*MetadClient, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("backend_metad: empty host")
+	}
+
+	requestTimeout, err := cfg.GetDurationOption("request_timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	retryBackoff, err := cfg.GetDurationOption("retry_backoff", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	retryMaxBackoff, err := cfg.GetDurationOption("retry_max_backoff", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxErrors, err := cfg.GetIntOption("max_errors", 3)
+	if err != nil {
+		return nil, err
+	}
+	if requestTimeout <= 0 || retryBackoff <= 0 || maxErrors <= 0 {
+		return nil, fmt.Errorf("backend_metad: request_timeout, retry_backoff and max_errors must be positive")
+	}
+
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
+	connections := ring.New(len(cfg.Host))
+	for _, backendNode := range cfg.Host {
+		url := backendNode
+		if !strings.Contains(url, "://") {
+			url = scheme + "://" + url
+		}
 		connection := &MetadConnection{
-			url: url,
+			url: strings.TrimSuffix(url, "/"),
 			httpClient: &http.Client{
 				Transport: &http.Transport{
 					Proxy: http.ProxyFromEnvironment,
@@ -74,6 +181,7 @@ func NewMetadClient(backendNodes []string) (*MetadClient, error) {
 						KeepAlive: 1 * time.Second,
 						DualStack: true,
 					}).DialContext,
+					TLSClientConfig: tlsConfig,
 				},
 			},
 		}
@@ -81,66 +189,134 @@ func NewMetadClient(backendNodes []string) (*MetadClient, error) {
 		connections = connections.Next()
 	}
 
+	// random start
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	connections = connections.Move(r.Intn(connections.Len()))
+
 	client := &MetadClient{
+		requestTimeout:  requestTimeout,
+		retryBackoff:    retryBackoff,
+		retryMaxBackoff: retryMaxBackoff,
+		maxErrors:       uint32(maxErrors),
+		manageURL:       strings.TrimSuffix(cfg.GetOption("manage_url", ""), "/"),
+		manageClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
 		connections: connections,
 	}
 
-	err := client.selectConnection()
+	_, err = client.selectConnection(context.Background())
 
 	return client, err
 }
 
-func (c *MetadClient) selectConnection() error {
-	maxTime := 15 * time.Second
-	i := 1 * time.Second
-	for ; i < maxTime; i *= time.Duration(2) {
-		if conn, err := c.testConnection(); err == nil {
-			//found available conn
-			if c.current != nil {
-				atomic.StoreUint32(&c.current.errTimes, 0)
-			}
+// getConnection returns the current connection, or selects a new one
+// if the current connection failed max errors times.
+func (c *MetadClient) getConnection(ctx context.Context) (*MetadConnection, error) {
+	c.mu.Lock()
+	conn := c.current
+	c.mu.Unlock()
+
+	if conn != nil && atomic.LoadUint32(&conn.errTimes) < c.maxErrors {
+		return conn, nil
+	}
+	return c.selectConnection(ctx)
+}
+
+// selectConnection tests the connections of the ring until an available
+// one is found, the backoff between rounds is doubled until it reaches
+// retryMaxBackoff.
+func (c *MetadClient) selectConnection(ctx context.Context) (*MetadConnection, error) {
+	for backoff := c.retryBackoff; ; backoff *= 2 {
+		conn, err := c.testConnection(ctx)
+		if err == nil {
+			// found available conn
+			atomic.StoreUint32(&conn.errTimes, 0)
+
+			c.mu.Lock()
 			c.current = conn
-			break
+			c.mu.Unlock()
+
+			logger.Info("Using Metad URL: " + conn.url)
+			return conn, nil
+		}
+
+		if backoff >= c.retryMaxBackoff {
+			return nil, fmt.Errorf("backend_metad: fail to connect any backend: %v", err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		time.Sleep(i)
-	}
-	if i >= maxTime {
-		return fmt.Errorf("fail to connect any backend.")
 	}
-	logger.Info("Using Metad URL: " + c.current.url)
-	return nil
 }
 
-func (c *MetadClient) testConnection() (*MetadConnection, error) {
-	//random start
-	if c.current == nil {
-		rand.Seed(time.Now().Unix())
-		r := rand.Intn(c.connections.Len())
-		c.connections = c.connections.Move(r)
-	}
-	c.connections = c.connections.Next()
-	conn := c.connections.Value.(*MetadConnection)
-	startConn := conn
-	_, err := conn.makeMetaDataRequest("/")
-	for err != nil {
-		logger.Error("connection to [%s], error: [%v]", conn.url, err)
+// testConnection tests the connections of the ring from the next one,
+// and returns the first available connection or the last error.
+func (c *MetadClient) testConnection(ctx context.Context) (*MetadConnection, error) {
+	c.mu.Lock()
+	n := c.connections.Len()
+	c.mu.Unlock()
+
+	var lastErr error
+	for i := 0; i < n; i++ {
+		c.mu.Lock()
 		c.connections = c.connections.Next()
-		conn = c.connections.Value.(*MetadConnection)
-		if conn == startConn {
-			break
+		conn := c.connections.Value.(*MetadConnection)
+		c.mu.Unlock()
+
+		reqCtx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+		_, err := conn.makeMetaDataRequest(reqCtx, "/")
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		_, err = conn.makeMetaDataRequest("/")
+
+		logger.Errorf("connection to [%s], error: [%v]", conn.url, err)
+		lastErr = err
 	}
-	return conn, err
+	return nil, lastErr
 }
 
 func (c *MetadClient) GetValues(keys []string) (map[string]string, error) {
+	return c.GetValuesContext(context.Background(), keys)
+}
+
+// GetValuesContext queries metad for keys.
+// If ctx has no deadline, each key times out after request_timeout.
+func (c *MetadClient) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
 	vars := map[string]string{}
 
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return vars, err
+	}
+
+	_, hasDeadline := ctx.Deadline()
+
 	for _, key := range keys {
-		body, err := c.current.makeMetaDataRequest(key)
+		keyCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !hasDeadline {
+			keyCtx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		}
+		body, err := conn.makeMetaDataRequest(keyCtx, key)
+		cancel()
 		if err != nil {
-			atomic.AddUint32(&c.current.errTimes, 1)
+			if e, ok := err.(*RequestError); ok && e.StatusCode == http.StatusNotFound {
+				continue // no such key
+			}
+			if ctx.Err() != nil {
+				return vars, ctx.Err()
+			}
+			atomic.AddUint32(&conn.errTimes, 1)
 			return vars, err
 		}
 
@@ -149,116 +325,168 @@ func (c *MetadClient) GetValues(keys []string) (map[string]string, error) {
 			return vars, err
 		}
 
-		if err = treeWalk(key, jsonResponse, vars); err != nil {
+		if err = libconfd.FlattenTree(key, jsonResponse, vars); err != nil {
 			return vars, err
 		}
 	}
 	return vars, nil
 }
 
-func treeWalk(root string, val interface{}, vars map[string]string) error {
-	switch val.(type) {
-	case map[string]interface{}:
-		for k := range val.(map[string]interface{}) {
-			treeWalk(strings.Join([]string{root, k}, "/"), val.(map[string]interface{})[k], vars)
-		}
-	case []interface{}:
-		for i, item := range val.([]interface{}) {
-			idx := strconv.Itoa(i)
-			if i, isMap := item.(map[string]interface{}); isMap {
-				if name, exists := i["name"]; exists {
-					idx = name.(string)
-				}
-			}
+func (c *MetadClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-			treeWalk(strings.Join([]string{root, idx}, "/"), item, vars)
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
 		}
-	case bool:
-		vars[root] = strconv.FormatBool(val.(bool))
-	case string:
-		vars[root] = val.(string)
-	case float64:
-		vars[root] = strconv.FormatFloat(val.(float64), 'f', -1, 64)
-	case nil:
-		vars[root] = "null"
-	default:
-		logger.Error("Unknown type: " + reflect.TypeOf(val).Name())
+	}()
+
+	index, err := c.Watch(ctx, prefix, keys, waitIndex)
+	if err != nil && ctx.Err() != nil {
+		return index, nil // stopped
 	}
-	return nil
+	return index, err
 }
 
-func (c *MetadClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	if c.current.errTimes >= 3 {
-		c.selectConnection()
+// Watch waits until the prefix is changed after waitIndex, and returns
+// the X-Metad-OpVersion of metad. It returns ctx.Err() when ctx is done.
+func (c *MetadClient) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return waitIndex, err
 	}
 
-	conn := c.current
-
 	// return something > 0 to trigger a key retrieval from the store
 	if waitIndex == 0 {
-		conn.waitIndex = 1
-		return conn.waitIndex, nil
+		atomic.StoreUint64(&conn.waitIndex, 1)
+		return 1, nil
 	}
 	// when switch to anther server, so set waitIndex 0, and let server response current version.
-	if conn.waitIndex == 0 {
+	if atomic.LoadUint64(&conn.waitIndex) == 0 {
 		waitIndex = 0
 	}
 
-	done := make(chan struct{})
-	defer close(done)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?wait=true&prev_version=%d", conn.url, prefix, waitIndex), nil)
+	// just ignore resp, notify confd to reload metadata from metad
+	resp, err := conn.get(ctx, fmt.Sprintf("%s?wait=true&prev_version=%d", prefix, waitIndex))
 	if err != nil {
-		return conn.waitIndex, err
+		if ctx.Err() != nil {
+			return atomic.LoadUint64(&conn.waitIndex), ctx.Err()
+		}
+		logger.Errorf("failed to watch prefix %s: %v", prefix, err)
+		atomic.AddUint32(&conn.errTimes, 1)
+		return atomic.LoadUint64(&conn.waitIndex), err
+	}
+	resp.Body.Close()
+
+	newIndex := atomic.LoadUint64(&conn.waitIndex) + 1
+	if versionStr := resp.Header.Get("X-Metad-OpVersion"); versionStr != "" {
+		if v, err := strconv.ParseUint(versionStr, 10, 64); err == nil {
+			newIndex = v
+		} else {
+			logger.Errorf("Parse X-Metad-OpVersion %s error: %v", versionStr, err)
+		}
+	} else {
+		logger.Warning("Metad response miss X-Metad-OpVersion header.")
 	}
 
-	req.Header.Set("Accept", "application/json")
-	req = req.WithContext(ctx)
-	go func() {
-		select {
-		case <-stopChan:
-			cancel()
-		case <-done:
-			return
+	atomic.StoreUint64(&conn.waitIndex, newIndex)
+	return newIndex, nil
+}
+
+// SetValues updates the values with the manage API of metad, the values
+// are merged into the metadata in one request.
+func (c *MetadClient) SetValues(ctx context.Context, values map[string]string) error {
+	tree := map[string]interface{}{}
+	for key, value := range values {
+		terms := strings.Split(strings.Trim(key, "/"), "/")
+		if terms[0] == "" {
+			return fmt.Errorf("backend_metad: invalid key %q", key)
 		}
-	}()
 
-	// just ignore resp, notify confd to reload metadata from metad
-	resp, err := conn.httpClient.Do(req)
-	if resp != nil {
-		defer resp.Body.Close()
+		m := tree
+		for _, term := range terms[:len(terms)-1] {
+			if _, ok := m[term]; !ok {
+				m[term] = map[string]interface{}{}
+			}
+			sub, ok := m[term].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("backend_metad: key %q conflicts with its parent", key)
+			}
+			m = sub
+		}
+
+		last := terms[len(terms)-1]
+		if _, ok := m[last].(map[string]interface{}); ok {
+			return fmt.Errorf("backend_metad: key %q conflicts with its children", key)
+		}
+		m[last] = value
 	}
+
+	body, err := json.Marshal(tree)
 	if err != nil {
-		logger.Error("failed to connect to metad when watch prefix")
-		atomic.AddUint32(&conn.errTimes, 1)
-		return conn.waitIndex, err
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return conn.waitIndex, errors.New(fmt.Sprintf("metad response status [%v], requestID: [%s]", resp.StatusCode, resp.Header.Get("X-Metad-RequestID")))
+	return c.manage(ctx, "POST", "/v1/data", body)
+}
+
+// DeleteKeys deletes the keys and the keys under them with the manage
+// API of metad.
+func (c *MetadClient) DeleteKeys(ctx context.Context, keys []string) error {
+	if err := libconfd.ValidDeleteKeys(keys); err != nil {
+		return err
 	}
-	versionStr := resp.Header.Get("X-Metad-OpVersion")
-	if versionStr != "" {
-		v, err := strconv.ParseUint(versionStr, 10, 64)
-		if err != nil {
-			logger.Error("Parse X-Metad-OpVersion %s error:%s", versionStr, err.Error())
+	for _, key := range keys {
+		if err := c.manage(ctx, "DELETE", "/v1/data"+key, nil); err != nil {
+			return err
 		}
-		conn.waitIndex = v
-	} else {
-		logger.Warning("Metad response miss X-Metad-OpVersion header.")
-		conn.waitIndex = conn.waitIndex + 1
 	}
-	return conn.waitIndex, nil
+	return nil
 }
 
-func (c *MetadConnection) makeMetaDataRequest(path string) ([]byte, error) {
-	req, err := http.NewRequest("GET", strings.Join([]string{c.url, path}, ""), nil)
+// manage sends a request to the manage API, a non-2xx response is
+// returned as a *RequestError.
+// If ctx has no deadline, the request times out after request_timeout.
+func (c *MetadClient) manage(ctx context.Context, method, path string, body []byte) error {
+	if c.manageURL == "" {
+		return fmt.Errorf("backend_metad: manage_url is not set")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	url := c.manageURL + path
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return &RequestError{Method: method, URL: url, Err: err}
 	}
-	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.manageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return &RequestError{Method: method, URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &RequestError{
+			Method:     method,
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			RequestID:  resp.Header.Get("X-Metad-RequestID"),
+		}
+	}
+	return nil
+}
+
+func (c *MetadConnection) makeMetaDataRequest(ctx context.Context, path string) ([]byte, error) {
+	resp, err := c.get(ctx, path)
 	if err != nil {
 		return nil, err
 	}
@@ -266,3 +494,29 @@ func (c *MetadConnection) makeMetaDataRequest(path string) ([]byte, error) {
 
 	return ioutil.ReadAll(resp.Body)
 }
+
+// get sends a GET request of path, a non-200 response is returned
+// as a *RequestError.
+func (c *MetadConnection) get(ctx context.Context, path string) (*http.Response, error) {
+	url := c.url + path
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, &RequestError{URL: url, Err: err}
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &RequestError{URL: url, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &RequestError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			RequestID:  resp.Header.Get("X-Metad-RequestID"),
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_metad
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+// tFakeMetad serves the keys as the metad metadata API.
+type tFakeMetad struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	values  map[string]string
+	version uint64
+	changed chan struct{}
+}
+
+func tNewFakeMetad(values map[string]string, tlsEnabled bool) *tFakeMetad {
+	p := &tFakeMetad{
+		values:  values,
+		version: 1,
+		changed: make(chan struct{}),
+	}
+	if tlsEnabled {
+		p.Server = httptest.NewTLSServer(http.HandlerFunc(p.serveHTTP))
+	} else {
+		p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	}
+	return p
+}
+
+func (p *tFakeMetad) Set(key, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.values[key] = value
+	p.version++
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// serveManage serves the manage API, POST merges the JSON object into
+// the keys, DELETE deletes the keys under the path.
+func (p *tFakeMetad) serveManage(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch r.Method {
+	case "POST":
+		var tree interface{}
+		if err := json.NewDecoder(r.Body).Decode(&tree); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values := map[string]string{}
+		libconfd.FlattenTree("", tree, values)
+		for k, v := range values {
+			p.values[k] = v
+		}
+	case "DELETE":
+		key := strings.TrimPrefix(r.URL.Path, "/v1/data")
+		for k := range p.values {
+			if k == key || strings.HasPrefix(k, key+"/") {
+				delete(p.values, k)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *tFakeMetad) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Metad-RequestID", "req-1")
+
+	if strings.HasPrefix(r.URL.Path, "/v1/data") {
+		p.serveManage(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("wait") == "true" {
+		prev, _ := strconv.ParseUint(r.URL.Query().Get("prev_version"), 10, 64)
+
+		p.mu.Lock()
+		version, changed := p.version, p.changed
+		p.mu.Unlock()
+
+		if prev != 0 && prev >= version {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			p.mu.Lock()
+			version = p.version
+			p.mu.Unlock()
+		}
+
+		w.Header().Set("X-Metad-OpVersion", strconv.FormatUint(version, 10))
+		w.Write([]byte("{}"))
+		return
+	}
+
+	if r.URL.Path == "/error" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if v, ok := p.values[r.URL.Path]; ok {
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+
+	// nested object of the keys under path
+	prefix := strings.TrimSuffix(r.URL.Path, "/") + "/"
+	tree := map[string]interface{}{}
+	for k, v := range p.values {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		terms := strings.Split(strings.TrimPrefix(k, prefix), "/")
+		m := tree
+		for _, term := range terms[:len(terms)-1] {
+			if _, ok := m[term].(map[string]interface{}); !ok {
+				m[term] = map[string]interface{}{}
+			}
+			m = m[term].(map[string]interface{})
+		}
+		m[terms[len(terms)-1]] = v
+	}
+	if len(tree) == 0 && r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(tree)
+}
+
+func tNewMetadClient(tb testing.TB, hosts []string, options map[string]string) *MetadClient {
+	tb.Helper()
+
+	c, err := NewMetadClientWithConfig(&libconfd.BackendConfig{
+		Type:    MetadBackendType,
+		Host:    hosts,
+		Options: options,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestMetadClient_GetValues(t *testing.T) {
+	metad := tNewFakeMetad(map[string]string{
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+		"/key":     "foobar",
+	}, false)
+	defer metad.Close()
+
+	c := tNewMetadClient(t, []string{metad.URL}, nil)
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	_, err = c.GetValues([]string{"/error"})
+	if e, ok := err.(*RequestError); !ok || e.StatusCode != 500 || e.RequestID != "req-1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMetadClient_SetValues(t *testing.T) {
+	metad := tNewFakeMetad(map[string]string{
+		"/db/host":  "127.0.0.1",
+		"/dbx/host": "10.0.0.1",
+	}, false)
+	defer metad.Close()
+
+	c := tNewMetadClient(t, []string{metad.URL}, nil)
+	if err := c.SetValues(context.Background(), map[string]string{"/key": "foobar"}); err == nil {
+		t.Fatal("expect error without manage_url")
+	}
+	c.Close()
+
+	c = tNewMetadClient(t, []string{metad.URL}, map[string]string{"manage_url": metad.URL})
+	defer c.Close()
+
+	err := c.SetValues(context.Background(), map[string]string{
+		"/db/port": "3306",
+		"/key":     "foobar",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteKeys(context.Background(), []string{"/db"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/", "", "db"} {
+		if err := c.DeleteKeys(context.Background(), []string{key}); err == nil {
+			t.Fatalf("expect error of key %q", key)
+		}
+	}
+
+	m, err := c.GetValues([]string{"/db", "/dbx", "/key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/dbx/host": "10.0.0.1",
+		"/key":      "foobar",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	err = c.SetValues(context.Background(), map[string]string{"/a": "1", "/a/b": "2"})
+	if err == nil {
+		t.Fatal("expect conflict error")
+	}
+}
+
+func TestMetadClient_https(t *testing.T) {
+	metad := tNewFakeMetad(map[string]string{"/key": "foobar"}, true)
+	defer metad.Close()
+
+	caFile, err := ioutil.TempFile("", "libconfd-metad-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: metad.Certificate().Raw})
+	caFile.Close()
+
+	c, err := NewMetadClientWithConfig(&libconfd.BackendConfig{
+		Type:         MetadBackendType,
+		Host:         []string{strings.TrimPrefix(metad.URL, "https://")},
+		ClientCAKeys: caFile.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["/key"] != "foobar" {
+		t.Fatalf("unexpected values: %v", m)
+	}
+}
+
+func TestMetadClient_failover(t *testing.T) {
+	values := map[string]string{"/key": "foobar"}
+
+	metads := []*tFakeMetad{
+		tNewFakeMetad(values, false),
+		tNewFakeMetad(values, false),
+	}
+	defer metads[0].Close()
+	defer metads[1].Close()
+
+	c := tNewMetadClient(t, []string{metads[0].URL, metads[1].URL}, map[string]string{
+		"retry_backoff":     "10ms",
+		"retry_max_backoff": "100ms",
+		"max_errors":        "1",
+	})
+	defer c.Close()
+
+	// stop the current one
+	current, other := metads[0], metads[1]
+	if c.current.url == other.URL {
+		current, other = other, current
+	}
+	current.Close()
+
+	if _, err := c.GetValues([]string{"/key"}); err == nil {
+		t.Fatal("expect error")
+	}
+
+	m, err := c.GetValues([]string{"/key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["/key"] != "foobar" {
+		t.Fatalf("unexpected values: %v", m)
+	}
+	if c.current.url != other.URL {
+		t.Fatalf("current = %s, expect = %s", c.current.url, other.URL)
+	}
+
+	// all stopped
+	other.Close()
+
+	start := time.Now()
+	if _, err := c.GetValues([]string{"/key"}); err == nil {
+		t.Fatal("expect error")
+	}
+	if _, err := c.GetValues([]string{"/key"}); err == nil {
+		t.Fatal("expect error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("retry too long: %v", d)
+	}
+}
+
+func TestMetadClient_WatchPrefix(t *testing.T) {
+	metad := tNewFakeMetad(map[string]string{"/key": "foobar"}, false)
+	defer metad.Close()
+
+	c := tNewMetadClient(t, []string{metad.URL}, nil)
+	defer c.Close()
+
+	stopChan := make(chan bool)
+
+	index, err := c.WatchPrefix("/", nil, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Fatalf("index = %d, expect = 1", index)
+	}
+
+	watch := func(waitIndex uint64) chan uint64 {
+		ch := make(chan uint64, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", nil, waitIndex, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- index
+		}()
+		return ch
+	}
+
+	ch := watch(index)
+	select {
+	case index := <-ch:
+		t.Fatalf("unexpected return: %d", index)
+	case <-time.After(time.Second / 5):
+	}
+
+	metad.Set("/key", "changed")
+
+	select {
+	case index = <-ch:
+		if index != 2 {
+			t.Fatalf("index = %d, expect = 2", index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+
+	select {
+	case newIndex := <-ch:
+		if newIndex != index {
+			t.Fatalf("index = %d, expect = %d", newIndex, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPrefix is not stopped")
+	}
+}
@@ -36,6 +36,18 @@ func WithInterval(interval int) Options {
 	}
 }
 
+func WithIntervalJitter(jitter int) Options {
+	return func(opt *Config) {
+		opt.IntervalJitter = jitter
+	}
+}
+
+func WithHealthCheckInterval(interval int) Options {
+	return func(opt *Config) {
+		opt.HealthCheckInterval = interval
+	}
+}
+
 func WithWatchMode() Options {
 	return func(opt *Config) {
 		opt.Onetime = false
@@ -43,6 +55,32 @@ func WithWatchMode() Options {
 	}
 }
 
+func WithHybridMode(resyncInterval int) Options {
+	return func(opt *Config) {
+		opt.Onetime = false
+		opt.Watch = true
+		opt.ResyncInterval = resyncInterval
+	}
+}
+
+func WithDebounce(debounceMs int) Options {
+	return func(opt *Config) {
+		opt.Debounce = debounceMs
+	}
+}
+
+func WithMinReloadInterval(interval int) Options {
+	return func(opt *Config) {
+		opt.MinReloadInterval = interval
+	}
+}
+
+func WithConcurrency(n int) Options {
+	return func(opt *Config) {
+		opt.Concurrency = n
+	}
+}
+
 func WithFuncMap(maps ...template.FuncMap) Options {
 	return func(opt *Config) {
 		if opt.FuncMap == nil {
@@ -85,3 +123,15 @@ func WithHookOnUpdateDone(fn func(trName string, err error)) Options {
 		opt.HookOnUpdateDone = fn
 	}
 }
+
+func WithHookOnSnapshot(fn func(trName string, revision uint64)) Options {
+	return func(opt *Config) {
+		opt.HookOnSnapshot = fn
+	}
+}
+
+func WithHookOnHealthChange(fn func(state HealthState, err error)) Options {
+	return func(opt *Config) {
+		opt.HookOnHealthChange = fn
+	}
+}
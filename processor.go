@@ -6,16 +6,89 @@
 package libconfd
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+// the grace period of Close to wait for the running calls
+const defaultCloseTimeout = 10 * time.Second
+
+var errProcessorShutDown = errors.New("libconfd: processor is shut down")
+
 type Call struct {
 	Config *Config
 	Client BackendClient
 	Error  error
 	Done   chan *Call
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	health healthMonitor
+
+	workers chan struct{}  // limits the templates processed at the same time
+	order   *templateOrder // the first renders in watch mode
+
+	mu         sync.Mutex
+	status     CallStatus
+	startTime  time.Time
+	finishTime time.Time
+	results    map[string]TemplateResult // name => last result
+}
+
+// HealthState returns the health state of the backend and the error of
+// the last check. The backend is checked periodically except in onetime
+// mode, see Config.HealthCheckInterval.
+func (call *Call) HealthState() (HealthState, error) {
+	state, err, _ := call.health.get()
+	return state, err
+}
+
+// setHealth updates the health state with the result of a check, and
+// calls HookOnHealthChange if the state is changed.
+func (call *Call) setHealth(err error) {
+	state, changed := call.health.update(err)
+	if !changed {
+		return
+	}
+
+	if err != nil {
+		GetLogger().Warningf("libconfd: backend %s is %v: %v", call.Client.Type(), state, err)
+	} else {
+		GetLogger().Infof("libconfd: backend %s is %v", call.Client.Type(), state)
+	}
+
+	if fn := call.Config.HookOnHealthChange; fn != nil {
+		fn(state, err)
+	}
+}
+
+// waitHealthy waits until the backend is not down.
+// It returns false if ctx is done.
+func (call *Call) waitHealthy(ctx context.Context) bool {
+	for {
+		state, _, changed := call.health.get()
+		if state != HealthDown {
+			return ctx.Err() == nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// getContext returns the context of the call, it is canceled when the
+// Processor is closed.
+func (call *Call) getContext() context.Context {
+	if call.ctx == nil {
+		return context.Background()
+	}
+	return call.ctx
 }
 
 func (call *Call) done() {
@@ -32,28 +105,34 @@ func (call *Call) done() {
 type Processor struct {
 	pendingMutex sync.Mutex
 	pending      []*Call
+	active       []*Call       // queued and running calls
+	closed       bool          // no more calls are accepted
+	wakeup       chan struct{} // signaled when a call is added
 
-	closeChan chan bool
-	wg        sync.WaitGroup
-}
-
-func (p *Processor) isClosing() bool {
-	if p.closeChan == nil {
-		GetLogger().Panic("closeChan is nil")
-	}
-	select {
-	case <-p.closeChan:
-		return true
-	default:
-		return false
-	}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func (p *Processor) addPendingCall(call *Call) {
 	p.pendingMutex.Lock()
 	defer p.pendingMutex.Unlock()
 
+	if p.closed {
+		GetLogger().Error(errProcessorShutDown)
+		call.Error = errProcessorShutDown
+		call.finish()
+		call.done()
+		return
+	}
+
 	p.pending = append(p.pending, call)
+	p.active = append(p.active, call)
+
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
 }
 func (p *Processor) getPendingCall() *Call {
 	p.pendingMutex.Lock()
@@ -71,63 +150,146 @@ func (p *Processor) clearPendingCall() {
 	p.pendingMutex.Lock()
 	defer p.pendingMutex.Unlock()
 
+	p.closed = true
+
 	for _, call := range p.pending {
-		err := errors.New("libconfd: processor is shut down")
-		GetLogger().Error(err)
-		call.Error = err
+		GetLogger().Error(errProcessorShutDown)
+		call.Error = errProcessorShutDown
+		call.finish()
+		p.removeActiveCallLocked(call)
 		call.done()
 	}
 
 	p.pending = p.pending[:0]
 }
 
-func (p *Processor) checkBackendClient(client BackendClient) error {
-	_, err := client.GetValues([]string{"/"})
-	if err != nil {
+func (p *Processor) removeActiveCall(call *Call) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	p.removeActiveCallLocked(call)
+}
+
+func (p *Processor) removeActiveCallLocked(call *Call) {
+	for i, x := range p.active {
+		if x == call {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// ActiveCalls returns the queued and running calls, in the order they
+// are submitted.
+func (p *Processor) ActiveCalls() []*Call {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	return append([]*Call{}, p.active...)
+}
+
+func (p *Processor) checkBackendClient(ctx context.Context, cfg *Config, client BackendClient) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.GetBackendTimeout())
+	defer cancel()
+
+	if err := checkBackendHealth(ctx, client); err != nil {
 		GetLogger().Error(err)
 		return err
 	}
 	return nil
 }
 
-func NewProcessor() *Processor {
-	p := &Processor{
-		closeChan: make(chan bool),
+// monitorHealth checks the backend of call every HealthCheckInterval,
+// the failed checks are retried with exponential backoff.
+func (p *Processor) monitorHealth(ctx context.Context, call *Call) {
+	interval := call.Config.GetHealthCheckInterval()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(call.health.nextCheck(interval)):
+		}
+
+		err := p.checkBackendClient(ctx, call.Config, call.Client)
+		if ctx.Err() != nil {
+			return
+		}
+		call.setHealth(err)
 	}
+}
+
+func NewProcessor() *Processor {
+	p := new(Processor)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.wakeup = make(chan struct{}, 1)
 
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 
 		for {
-			if p.isClosing() {
+			select {
+			case <-p.ctx.Done():
 				p.clearPendingCall()
 				return
+			case <-p.wakeup:
 			}
 
-			call := p.getPendingCall()
-			if call == nil {
-				time.Sleep(time.Second / 10)
-				continue
+			for call := p.getPendingCall(); call != nil; call = p.getPendingCall() {
+				p.start(call)
 			}
-
-			p.wg.Add(1)
-			go func() {
-				GetLogger().Debugln("process start")
-				defer GetLogger().Debugln("process done")
-
-				defer p.wg.Done()
-				defer call.done()
-
-				p.process(call)
-			}()
 		}
 	}()
 
 	return p
 }
 
+// start runs call in a new goroutine, a canceled call is done at once
+// without running.
+func (p *Processor) start(call *Call) {
+	// the call is canceled by itself, its context or the Processor
+	ctx := call.getContext()
+
+	// a call canceled in the queue is never running
+	if ctx.Err() != nil {
+		p.removeActiveCall(call)
+		call.finishCanceled()
+		call.done()
+		return
+	}
+
+	call.setRunning()
+
+	p.wg.Add(1)
+	go func() {
+		GetLogger().Debugln("process start")
+		defer GetLogger().Debugln("process done")
+
+		defer p.wg.Done()
+		defer call.done()
+		defer p.removeActiveCall(call)
+		defer call.finish()
+		defer call.Cancel()
+
+		go func() {
+			select {
+			case <-p.ctx.Done():
+				call.Cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		p.process(call)
+	}()
+}
+
 func (p *Processor) Go(cfg *Config, client BackendClient, opts ...Options) *Call {
+	return p.GoContext(context.Background(), cfg, client, opts...)
+}
+
+// GoContext is like Go, the call is stopped when ctx is done.
+func (p *Processor) GoContext(ctx context.Context, cfg *Config, client BackendClient, opts ...Options) *Call {
 	if client == nil {
 		GetLogger().Panic("client is nil")
 	}
@@ -137,25 +299,35 @@ func (p *Processor) Go(cfg *Config, client BackendClient, opts ...Options) *Call
 	call.Config = cfg.Clone().applyOptions(opts...)
 	call.Client = client
 	call.Done = make(chan *Call, 10) // buffered.
+	call.ctx, call.cancel = context.WithCancel(ctx)
 
 	if err := cfg.Valid(); err != nil {
 		GetLogger().Error(err)
 		call.Error = err
+		call.Cancel()
+		call.finish()
 		call.done()
 		return call
 	}
 
 	// just print the when check failed
-	if err := p.checkBackendClient(client); err != nil {
+	err := p.checkBackendClient(ctx, call.Config, client)
+	if err != nil {
 		GetLogger().Warning(err)
 		// donot return
 	}
+	call.setHealth(err)
 
 	p.addPendingCall(call)
 	return call
 }
 
 func (p *Processor) Run(cfg *Config, client BackendClient, opts ...Options) error {
+	return p.RunContext(context.Background(), cfg, client, opts...)
+}
+
+// RunContext is like Run, it returns when ctx is done.
+func (p *Processor) RunContext(ctx context.Context, cfg *Config, client BackendClient, opts ...Options) error {
 	if err := cfg.Valid(); err != nil {
 		GetLogger().Error(err)
 		return err
@@ -164,7 +336,7 @@ func (p *Processor) Run(cfg *Config, client BackendClient, opts ...Options) erro
 		GetLogger().Panic("client is nil")
 	}
 
-	call := <-p.Go(cfg, client, opts...).Done
+	call := <-p.GoContext(ctx, cfg, client, opts...).Done
 	if err := call.Error; err != nil {
 		GetLogger().Error(err)
 		return err
@@ -173,13 +345,52 @@ func (p *Processor) Run(cfg *Config, client BackendClient, opts ...Options) erro
 	return nil
 }
 
+// Close stops all calls, and waits at most 10 seconds for them to return.
 func (p *Processor) Close() error {
-	close(p.closeChan)
-	p.wg.Wait()
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+
+	return p.CloseContext(ctx)
+}
+
+// CloseContext stops all calls, and waits for them to return until ctx
+// is done. It returns ctx.Err() if some calls are still running, such as
+// a blocking check or reload command.
+func (p *Processor) CloseContext(ctx context.Context) error {
+	p.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		GetLogger().Warning("libconfd: processor is closed with running calls")
+		return ctx.Err()
+	}
 }
 
 func (p *Processor) process(call *Call) {
+	call.workers = make(chan struct{}, call.Config.GetConcurrency())
+
+	if !call.Config.Onetime {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+
+		ctx, cancel := context.WithCancel(call.getContext())
+		defer cancel()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.monitorHealth(ctx, call)
+		}()
+	}
+
 	switch {
 	case call.Config.Onetime:
 		p.runOnce(call)
@@ -198,17 +409,14 @@ func (p *Processor) runOnce(call *Call) {
 		return
 	}
 
-	for _, t := range ts {
-		if p.isClosing() {
-			return
-		}
-
-		if err := t.Process(call); err != nil {
-			GetLogger().Error(err)
-		}
+	g, err := newTemplateGraph(ts)
+	if err != nil {
+		GetLogger().Error(err)
+		call.Error = err
+		return
 	}
 
-	return
+	p.runTemplates(call.getContext(), call, ts, g)
 }
 
 func (p *Processor) runInIntervalMode(call *Call) {
@@ -219,26 +427,47 @@ func (p *Processor) runInIntervalMode(call *Call) {
 		return
 	}
 
+	g, err := newTemplateGraph(ts)
+	if err != nil {
+		GetLogger().Warning(err)
+		call.Error = err
+		return
+	}
+
+	ctx := call.getContext()
+
+	// a slow round skips the missed ticks, instead of running at once
+	ticker := time.NewTicker(call.Config.GetInterval())
+	defer ticker.Stop()
+
 	for {
-		if p.isClosing() {
+		// skip the backend requests until the backend is recovered
+		if !call.waitHealthy(ctx) {
 			return
 		}
 
-		for _, t := range ts {
-			if p.isClosing() {
-				return
-			}
+		p.runTemplates(ctx, call, ts, g)
 
-			if err := t.Process(call); err != nil {
-				GetLogger().Error(err)
-				continue
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		time.Sleep(time.Duration(call.Config.Interval) * time.Second)
+		if jitter := call.Config.GetIntervalJitter(); jitter > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+			}
+		}
 	}
 }
 
+// runInWatchMode watches each template in a goroutine, since the backend
+// watches are blocking, so there is one goroutine per template resource.
+// The renders and reloads are limited by the workers of call, and the
+// first render of a template waits for the templates it depends on.
 func (p *Processor) runInWatchMode(call *Call) {
 	ts, err := MakeAllTemplateResourceProcessor(call.Config, call.Client)
 	if err != nil {
@@ -246,33 +475,38 @@ func (p *Processor) runInWatchMode(call *Call) {
 		return
 	}
 
+	g, err := newTemplateGraph(ts)
+	if err != nil {
+		GetLogger().Warning(err)
+		call.Error = err
+		return
+	}
+	call.order = newTemplateOrder(ts, g)
+
 	var wg sync.WaitGroup
-	var stopChan = make(chan bool)
+	var ctx = call.getContext()
 
 	for i := 0; i < len(ts); i++ {
 		wg.Add(1)
 		go func(t *TemplateResourceProcessor) {
 			defer wg.Done()
-			p.monitorPrefix(t, &wg, stopChan, call)
+			p.monitorPrefix(ctx, t, call)
 		}(ts[i])
 	}
 
-	for {
-		time.Sleep(time.Second / 2)
-
-		if p.isClosing() {
-			close(stopChan)
-			break
-		}
-	}
-
 	wg.Wait()
 	return
 }
 
+// the backoff of retrying a failed watch in watch mode
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
+)
+
 func (p *Processor) monitorPrefix(
+	ctx context.Context,
 	t *TemplateResourceProcessor,
-	wg *sync.WaitGroup, stopChan chan bool,
 	call *Call,
 ) {
 	keys := t.getAbsKeys()
@@ -284,20 +518,227 @@ func (p *Processor) monitorPrefix(
 		}
 	}
 
+	limiter := newRenderLimiter(call.Config, t)
+	defer limiter.Stop()
+
+	// hybrid mode: render at startup, and resync periodically
+	var resync <-chan time.Time
+	var rendered bool
+	if interval := call.Config.GetResyncInterval(); interval > 0 {
+		p.render(ctx, t, call)
+		limiter.Rendered()
+		rendered = true
+
+		// watch the changes after the rendered snapshot if the revision
+		// is known, see SnapshotReader
+		t.lastIndex = t.store.Revision()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	if w, ok := toEventWatcher(call.Client); ok {
+		p.monitorEvents(ctx, t, w, keys, call, resync, limiter, rendered)
+		return
+	}
+
+	type watchResult struct {
+		index uint64
+		err   error
+	}
+
+	// the watch runs in background, so the resync is not blocked
+	results := make(chan watchResult, 1)
+	watch := func(waitIndex uint64) {
+		go func() {
+			index, err := t.client.Watch(ctx, t.Prefix, keys, waitIndex)
+			results <- watchResult{index, err}
+		}()
+	}
+	watch(t.lastIndex)
+
+	// the first watch from index 0 returns the current index at once,
+	// it is only the baseline of the initial render
+	baseline := rendered && t.lastIndex == 0
+
+	// a failed watch is retried after backoff, which is doubled on each
+	// error up to maxWatchBackoff, so a persistent error does not spin
+	var backoff time.Duration
+	var retry <-chan time.Time
+	var retryTimer *time.Timer
+	defer func() {
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+	}()
+
 	for {
-		if p.isClosing() {
+		select {
+		case <-ctx.Done():
 			return
+
+		case <-retry:
+			retry = nil
+			watch(t.lastIndex)
+
+		case <-resync:
+			GetLogger().Debugf("%s: resync", t.path)
+			p.render(ctx, t, call)
+			limiter.Rendered()
+
+		case <-limiter.C():
+			p.render(ctx, t, call)
+			limiter.Rendered()
+
+		case r := <-results:
+			// watch some key changed
+			if ctx.Err() != nil {
+				return
+			}
+			if r.err != nil {
+				GetLogger().Error(r.err)
+
+				if !call.waitHealthy(ctx) {
+					return
+				}
+			}
+
+			// the changes are rendered by the limiter, and the next
+			// watch runs meanwhile, so the changes are coalesced
+			t.lastIndex = r.index
+			if !baseline || r.err != nil {
+				limiter.Changed()
+			}
+			baseline = false
+
+			if r.err == nil {
+				backoff = 0
+				watch(t.lastIndex)
+				continue
+			}
+
+			if backoff *= 2; backoff == 0 {
+				backoff = minWatchBackoff
+			} else if backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+			retryTimer = time.NewTimer(backoff)
+			retry = retryTimer.C
 		}
+	}
+}
+
+// render processes t in watch mode with a worker of call, so the
+// renders and reloads of all templates are limited by Config.Concurrency.
+func (p *Processor) render(ctx context.Context, t *TemplateResourceProcessor, call *Call) {
+	err := call.withTemplateWorker(ctx, t, func() error {
+		return t.ProcessContext(ctx, call)
+	})
+	if err != nil && ctx.Err() == nil {
+		GetLogger().Error(err)
+	}
+}
 
-		// watch some key changed
-		index, err := t.client.WatchPrefix(t.Prefix, keys, t.lastIndex, stopChan)
+// monitorEvents applies the change events of keys to the store of t,
+// the stream is resumed from the last revision if it is broken.
+//
+// The stream is restarted from a new snapshot on each resync, so the
+// events are never applied to a newer snapshot. The snapshot is always
+// rendered after a resync, and after the start if t is not rendered.
+func (p *Processor) monitorEvents(
+	ctx context.Context,
+	t *TemplateResourceProcessor,
+	w EventWatcher,
+	keys []string,
+	call *Call,
+	resync <-chan time.Time,
+	limiter *renderLimiter,
+	rendered bool,
+) {
+	forceReset := !rendered
+	for {
+		resynced, err := p.watchEvents(ctx, t, w, keys, call, resync, limiter, &forceReset)
+		if ctx.Err() != nil {
+			return
+		}
+		if resynced {
+			GetLogger().Debugf("%s: resync", t.path)
+			t.lastIndex = 0
+			forceReset = true
+			continue
+		}
 		if err != nil {
 			GetLogger().Error(err)
 		}
+		if !call.waitHealthy(ctx) {
+			return
+		}
 
-		t.lastIndex = index
-		if err := t.Process(call); err != nil {
-			GetLogger().Error(err)
+		// retry later
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(minWatchBackoff):
+		}
+	}
+}
+
+// watchEvents processes the event stream from t.lastIndex until it is
+// broken or resync fires, it reports whether it is stopped by resync.
+//
+// The events are applied to the store at once, and rendered by limiter.
+// A Reset batch is rendered only if it changes the store, or forceReset
+// is set, which is cleared by the first Reset batch.
+func (p *Processor) watchEvents(
+	ctx context.Context,
+	t *TemplateResourceProcessor,
+	w EventWatcher,
+	keys []string,
+	call *Call,
+	resync <-chan time.Time,
+	limiter *renderLimiter,
+	forceReset *bool,
+) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch, err := w.WatchEvents(ctx, t.Prefix, keys, t.lastIndex)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		select {
+		case <-resync:
+			return true, nil
+
+		case <-limiter.C():
+			err := call.withTemplateWorker(ctx, t, func() error {
+				return t.update(call)
+			})
+			if err != nil && ctx.Err() == nil {
+				GetLogger().Error(err)
+			}
+			limiter.Rendered()
+
+		case batch, ok := <-ch:
+			if !ok {
+				return false, nil
+			}
+			if batch.Err != nil {
+				return false, batch.Err
+			}
+			changed := t.applyEvents(call, batch)
+			if batch.Reset && *forceReset {
+				changed, *forceReset = true, false
+			}
+			if changed {
+				limiter.Changed()
+			} else {
+				GetLogger().Debugf("%s: no watched key changed, skip rendering", t.path)
+			}
+			t.lastIndex = batch.Revision
 		}
 	}
 }
@@ -0,0 +1,482 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tMakeConfDir creates a confdir with the template test.tmpl of keys,
+// which is rendered to <confdir>/test.out.
+func tMakeConfDir(tb testing.TB, tmpl string, keys ...string) *Config {
+	tb.Helper()
+
+	if len(keys) == 0 {
+		keys = []string{"/"}
+	}
+
+	dir, err := ioutil.TempDir("", "libconfd")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	files := map[string]string{
+		"conf.d/test.toml": `
+			[template]
+			src = "test.tmpl"
+			dest = "` + filepath.Join(dir, "test.out") + `"
+			keys = ` + fmt.Sprintf("%q", keys) + `
+		`,
+		"templates/test.tmpl": tmpl,
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return &Config{ConfDir: dir, Interval: 10, Prefix: "/"}
+}
+
+func TestProcessor_RunContext(t *testing.T) {
+	cfg := tMakeConfDir(t, `ok`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backend := tNewBlockingBackend()
+	close(backend.release)
+
+	p := NewProcessor()
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Second/2, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.RunContext(ctx, cfg, backend, WithWatchMode())
+	}()
+
+	select {
+	case err := <-done:
+		tAssert(t, err == nil, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext is not stopped")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.ConfDir, "test.out"))
+	tAssert(t, err == nil, err)
+	tAssert(t, string(data) == "ok", string(data))
+}
+
+func TestProcessor_Close(t *testing.T) {
+	cfg := tMakeConfDir(t, `ok`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backend := tNewBlockingBackend()
+	close(backend.release)
+
+	p := NewProcessor()
+	call := p.Go(cfg, backend, WithIntervalMode(), WithInterval(60), WithIntervalJitter(60))
+
+	// wait the first round
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(cfg.ConfDir, "test.out")); err == nil {
+			break
+		}
+		tAssert(t, time.Now().Before(deadline), "template is not processed")
+		time.Sleep(time.Second / 100)
+	}
+
+	start := time.Now()
+	err := p.Close()
+	tAssert(t, err == nil, err)
+	tAssert(t, time.Since(start) < time.Second, time.Since(start))
+
+	select {
+	case <-call.Done:
+	default:
+		t.Fatal("call is not done")
+	}
+
+	// closed
+	call = p.Go(cfg, backend, WithOnetimeMode())
+	select {
+	case call = <-call.Done:
+		tAssert(t, call.Error == errProcessorShutDown, call.Error)
+	case <-time.After(time.Second):
+		t.Fatal("call is not rejected")
+	}
+}
+
+func TestProcessor_backendTimeout(t *testing.T) {
+	cfg := tMakeConfDir(t, `ok`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	cfg.BackendTimeout = 1
+
+	backend := tNewBlockingBackend()
+	defer close(backend.release)
+
+	p := NewProcessor()
+	defer p.Close()
+
+	var updateErr error
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(cfg, backend, WithOnetimeMode(),
+			WithHookOnUpdateDone(func(trName string, err error) {
+				updateErr = err
+			}),
+		)
+	}()
+
+	select {
+	case <-done:
+		tAssert(t, updateErr == context.DeadlineExceeded, updateErr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run is not stopped")
+	}
+}
+
+func TestProcessor_events(t *testing.T) {
+	cfg := tMakeConfDir(t, `{{getv "/a/x"}}`, "/a")
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backendFile := filepath.Join(cfg.ConfDir, "backend.toml")
+	tWriteFile(t, backendFile, `"/a/x" = "1"`+"\n"+`"/b/x" = "1"`)
+
+	backend := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{backendFile}})
+	defer backend.Close()
+
+	var updated int32
+	waitUpdated := func(n int32) {
+		t.Helper()
+		for i := 0; i < 50 && atomic.LoadInt32(&updated) < n; i++ {
+			time.Sleep(time.Second / 10)
+		}
+		tAssertf(t, atomic.LoadInt32(&updated) == n, "updated = %d, expect = %d", atomic.LoadInt32(&updated), n)
+	}
+
+	p := NewProcessor()
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go p.RunContext(ctx, cfg, backend, WithWatchMode(),
+		WithHookOnUpdateDone(func(trName string, err error) {
+			atomic.AddInt32(&updated, 1)
+		}),
+	)
+
+	waitUpdated(1)
+
+	// other key
+	tWriteFile(t, backendFile, `"/a/x" = "1"`+"\n"+`"/b/x" = "2"`)
+	time.Sleep(time.Second / 2)
+	waitUpdated(1)
+
+	tWriteFile(t, backendFile, `"/a/x" = "2"`+"\n"+`"/b/x" = "2"`)
+	waitUpdated(2)
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.ConfDir, "test.out"))
+	tAssert(t, err == nil, err)
+	tAssert(t, string(data) == "2", string(data))
+}
+
+// tSnapshotBackend returns the values at a fixed revision.
+type tSnapshotBackend struct {
+	mu       sync.Mutex
+	values   map[string]string
+	revision uint64
+}
+
+func (p *tSnapshotBackend) Set(key, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	values := make(map[string]string)
+	for k, v := range p.values {
+		values[k] = v
+	}
+	values[key] = value
+	p.values = values
+}
+
+func (p *tSnapshotBackend) Type() string       { return "libconfd-backend-snapshot" }
+func (p *tSnapshotBackend) WatchEnabled() bool { return false }
+func (p *tSnapshotBackend) Close() error       { return nil }
+
+func (p *tSnapshotBackend) GetValues(keys []string) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.values, nil
+}
+
+func (p *tSnapshotBackend) GetSnapshot(ctx context.Context, keys []string) (map[string]string, uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.values, p.revision, nil
+}
+
+func (p *tSnapshotBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return waitIndex, nil
+}
+
+func TestProcessor_snapshotRevision(t *testing.T) {
+	cfg := tMakeConfDir(t, `{{getv "/a"}}@{{revision}}`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backend := &tSnapshotBackend{
+		values:   map[string]string{"/a": "1"},
+		revision: 42,
+	}
+
+	var hookRevision uint64
+	err := NewProcessor().Run(cfg, backend, WithOnetimeMode(),
+		WithHookOnSnapshot(func(trName string, revision uint64) {
+			hookRevision = revision
+		}),
+	)
+	tAssert(t, err == nil, err)
+	tAssert(t, hookRevision == 42, hookRevision)
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.ConfDir, "test.out"))
+	tAssert(t, err == nil, err)
+	tAssert(t, string(data) == "1@42", string(data))
+}
+
+func TestProcessor_Cancel(t *testing.T) {
+	cfg := tMakeConfDir(t, `{{getv "/a"}}`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backend := &tSnapshotBackend{values: map[string]string{"/a": "1"}}
+
+	p := NewProcessor()
+	defer p.Close()
+
+	call1 := p.Go(cfg, backend, WithIntervalMode(), WithInterval(60))
+	call2 := p.Go(cfg, backend, WithIntervalMode(), WithInterval(60))
+
+	calls := p.ActiveCalls()
+	tAssert(t, len(calls) == 2 && calls[0] == call1 && calls[1] == call2, calls)
+
+	// wait the first round
+	deadline := time.Now().Add(5 * time.Second)
+	for len(call1.Results()) == 0 {
+		tAssert(t, time.Now().Before(deadline), "template is not processed")
+		time.Sleep(time.Second / 100)
+	}
+	tAssert(t, call1.Status() == CallRunning, call1.Status())
+	tAssert(t, !call1.StartTime().IsZero() && call1.FinishTime().IsZero())
+
+	results := call1.Results()
+	tAssert(t, len(results) == 1 && results[0].Err == nil && results[0].Runs == 1, results)
+	tAssert(t, filepath.Base(results[0].Name) == "test.toml", results[0].Name)
+
+	call1.Cancel()
+	select {
+	case <-call1.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call is not canceled")
+	}
+	tAssert(t, call1.Status() == CallDone, call1.Status())
+	tAssert(t, !call1.FinishTime().IsZero())
+
+	// the other call is still running
+	calls = p.ActiveCalls()
+	tAssert(t, len(calls) == 1 && calls[0] == call2, calls)
+	tAssert(t, call2.Status() == CallRunning, call2.Status())
+
+	// canceled in the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	call := p.GoContext(ctx, cfg, backend, WithIntervalMode(), WithInterval(60))
+	select {
+	case <-call.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call is not canceled")
+	}
+	tAssert(t, call.Status() == CallCanceled, call.Status())
+	tAssert(t, call.StartTime().IsZero() && !call.FinishTime().IsZero())
+
+	// invalid config
+	call = p.Go(&Config{}, backend)
+	tAssert(t, call.Status() == CallFailed, call.Status())
+}
+
+// tAdjustedBackend stores the keys under /real.
+type tAdjustedBackend struct {
+	tSnapshotBackend
+}
+
+func (p *tAdjustedBackend) AdjustKey(key string) string {
+	return "/real" + key
+}
+
+func TestTemplateResourceProcessor_applyEvents(t *testing.T) {
+	call := &Call{Config: &Config{}, Client: &tAdjustedBackend{}}
+	tr := &TemplateResourceProcessor{
+		TemplateResource: TemplateResource{Prefix: "/", Keys: []string{"/a"}},
+		store:            NewKVStore(),
+	}
+
+	changed := tr.applyEvents(call, EventBatch{Reset: true, Revision: 1, Events: []Event{
+		{Type: EventPut, Key: "/real/a/x", NewValue: "1"},
+		{Type: EventPut, Key: "/real/b/x", NewValue: "1"},
+	}})
+	tAssert(t, changed)
+	tAssert(t, tr.store.Exists("/real/a/x") && !tr.store.Exists("/real/b/x"))
+
+	// the same snapshot
+	changed = tr.applyEvents(call, EventBatch{Reset: true, Revision: 2, Events: []Event{
+		{Type: EventPut, Key: "/real/a/x", NewValue: "1"},
+	}})
+	tAssert(t, !changed)
+	tAssert(t, tr.store.Revision() == 2, tr.store.Revision())
+
+	changed = tr.applyEvents(call, EventBatch{Revision: 3, Events: []Event{
+		{Type: EventDelete, Key: "/real/a/x"},
+	}})
+	tAssert(t, changed)
+	tAssert(t, !tr.store.Exists("/real/a/x"))
+}
+
+func TestProcessor_hybridMode(t *testing.T) {
+	cfg := tMakeConfDir(t, `{{getv "/a"}}`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	// the watch never returns
+	backend := &tSnapshotBackend{values: map[string]string{"/a": "1"}}
+
+	p := NewProcessor()
+	defer p.Close()
+
+	p.Go(cfg, backend, WithHybridMode(1))
+
+	expectFile := func(expect string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			data, _ := ioutil.ReadFile(filepath.Join(cfg.ConfDir, "test.out"))
+			if string(data) == expect {
+				return
+			}
+			tAssertf(t, time.Now().Before(deadline), "got = %q, expect = %q", data, expect)
+			time.Sleep(time.Second / 10)
+		}
+	}
+
+	// initial render
+	expectFile("1")
+
+	// resync
+	backend.Set("/a", "2")
+	expectFile("2")
+
+	// the first watch from index 0 is not rendered again
+	blocking := tNewBlockingBackend()
+	close(blocking.release)
+
+	call := p.Go(cfg, blocking, WithHybridMode(60))
+	time.Sleep(time.Second / 2)
+	results := call.Results()
+	tAssert(t, len(results) == 1 && results[0].Runs == 1, results)
+}
+
+func TestProcessor_hybridModeEvents(t *testing.T) {
+	cfg := tMakeConfDir(t, `{{getv "/a/x"}}`, "/a")
+	defer os.RemoveAll(cfg.ConfDir)
+
+	name := filepath.Join(cfg.ConfDir, "backend.toml")
+	tWriteFile(t, name, `"/a/x" = "1"`)
+
+	backend := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}})
+	defer backend.Close()
+
+	p := NewProcessor()
+	defer p.Close()
+
+	call := p.Go(cfg, backend, WithHybridMode(1))
+
+	// the initial render, the first snapshot is not rendered again
+	time.Sleep(time.Second / 2)
+	results := call.Results()
+	tAssert(t, len(results) == 1 && results[0].Runs == 1, results)
+
+	// resync
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if results := call.Results(); len(results) == 1 && results[0].Runs >= 2 {
+			tAssert(t, results[0].Failures == 0, results)
+			break
+		}
+		tAssertf(t, time.Now().Before(deadline), "results = %v", call.Results())
+		time.Sleep(time.Second / 10)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.ConfDir, "test.out"))
+	tAssert(t, err == nil, err)
+	tAssert(t, string(data) == "1", string(data))
+}
+
+// tFailingWatchBackend fails all watches after the first one.
+type tFailingWatchBackend struct {
+	mu      sync.Mutex
+	watches int
+}
+
+func (p *tFailingWatchBackend) Type() string       { return "libconfd-backend-failing-watch" }
+func (p *tFailingWatchBackend) WatchEnabled() bool { return true }
+func (p *tFailingWatchBackend) Close() error       { return nil }
+
+func (p *tFailingWatchBackend) GetValues(keys []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (p *tFailingWatchBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.watches++
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	return waitIndex, errors.New("watch failed")
+}
+
+func TestProcessor_watchBackoff(t *testing.T) {
+	cfg := tMakeConfDir(t, `ok`)
+	defer os.RemoveAll(cfg.ConfDir)
+
+	backend := &tFailingWatchBackend{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+
+	err := NewProcessor().RunContext(ctx, cfg, backend, WithWatchMode())
+	tAssert(t, err == nil, err)
+
+	// 0s, 0s, 1s, 2s: the failed watch is retried after 1s, 2s, ...
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	tAssert(t, backend.watches >= 2 && backend.watches <= 4, backend.watches)
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// acquireWorker waits for a free worker of the call, it returns false
+// if ctx is done. The workers are limited by Config.Concurrency.
+func (call *Call) acquireWorker(ctx context.Context) bool {
+	if call.workers == nil {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case call.workers <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (call *Call) releaseWorker() {
+	if call.workers != nil {
+		<-call.workers
+	}
+}
+
+// withWorker runs fn with a worker of call, the error of ctx is returned
+// if ctx is done before a worker is free.
+func (call *Call) withWorker(ctx context.Context, fn func() error) error {
+	if !call.acquireWorker(ctx) {
+		return ctx.Err()
+	}
+	defer call.releaseWorker()
+
+	return fn()
+}
+
+// withTemplateWorker runs fn of t in watch mode with a worker of call,
+// the first run waits until the templates t depends on are rendered once.
+func (call *Call) withTemplateWorker(ctx context.Context, t *TemplateResourceProcessor, fn func() error) error {
+	if !call.order.wait(ctx, t) {
+		return ctx.Err()
+	}
+	defer call.order.rendered(t)
+
+	return call.withWorker(ctx, fn)
+}
+
+// templateName returns the name of the template resource of path,
+// which is the base name without ".toml".
+func templateName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".toml")
+}
+
+// templateGraph is the dependency graph of template resources.
+type templateGraph struct {
+	deps       [][]int // index => the templates it depends on
+	dependents [][]int // index => the templates depending on it
+}
+
+// newTemplateGraph returns the dependency graph of ts by DependsOn.
+// The unknown dependencies are ignored, since they may be filtered out
+// on the platform. It returns an error if the dependencies have a cycle.
+func newTemplateGraph(ts []*TemplateResourceProcessor) (*templateGraph, error) {
+	index := make(map[string]int)
+	for i, t := range ts {
+		index[templateName(t.path)] = i
+	}
+
+	g := &templateGraph{
+		deps:       make([][]int, len(ts)),
+		dependents: make([][]int, len(ts)),
+	}
+	for i, t := range ts {
+		for _, name := range t.DependsOn {
+			j, ok := index[strings.TrimSuffix(name, ".toml")]
+			if !ok {
+				GetLogger().Warningf("libconfd: %s: unknown dependency %q", t.path, name)
+				continue
+			}
+			g.deps[i] = append(g.deps[i], j)
+			g.dependents[j] = append(g.dependents[j], i)
+		}
+	}
+
+	// depth first search for cycles
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(ts))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("libconfd: dependency cycle of %s", templateName(ts[i].path))
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		for _, j := range g.deps[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range ts {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// runTemplates processes ts with the workers of call, a template is
+// processed after the templates it depends on, and skipped if any of
+// them failed. The templates without dependencies between them are
+// started in order. It returns when all started templates are done.
+func (p *Processor) runTemplates(ctx context.Context, call *Call, ts []*TemplateResourceProcessor, g *templateGraph) {
+	type result struct {
+		i   int
+		err error
+	}
+
+	remaining := make([]int, len(ts)) // unfinished dependencies
+	depFailed := make([]bool, len(ts))
+	results := make(chan result, len(ts))
+
+	var ready []int
+	for i := range ts {
+		remaining[i] = len(g.deps[i])
+		if remaining[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	// done releases the dependents of the template i
+	var done func(i int, err error)
+	done = func(i int, err error) {
+		for _, j := range g.dependents[i] {
+			if err != nil {
+				depFailed[j] = true
+			}
+			if remaining[j]--; remaining[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+
+	var running int
+	for {
+		for len(ready) > 0 && ctx.Err() == nil {
+			i := ready[0]
+			if depFailed[i] {
+				ready = ready[1:]
+				err := fmt.Errorf("libconfd: %s: skipped since a dependency failed", ts[i].path)
+				GetLogger().Error(err)
+				done(i, err)
+				continue
+			}
+
+			if !call.acquireWorker(ctx) {
+				break
+			}
+			ready = ready[1:]
+			running++
+
+			go func(i int) {
+				defer call.releaseWorker()
+				results <- result{i, ts[i].ProcessContext(ctx, call)}
+			}(i)
+		}
+
+		if running == 0 {
+			return
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			GetLogger().Error(r.err)
+		}
+		done(r.i, r.err)
+	}
+}
+
+// templateOrder keeps the dependency order of the first renders in watch
+// mode. The dependents wait for the first render of a template even if it
+// failed, the later renders only follow the changes of their own keys.
+type templateOrder struct {
+	graph *templateGraph
+	index map[*TemplateResourceProcessor]int
+
+	once []sync.Once
+	done []chan struct{} // closed after the first render
+}
+
+func newTemplateOrder(ts []*TemplateResourceProcessor, g *templateGraph) *templateOrder {
+	o := &templateOrder{
+		graph: g,
+		index: make(map[*TemplateResourceProcessor]int),
+		once:  make([]sync.Once, len(ts)),
+		done:  make([]chan struct{}, len(ts)),
+	}
+	for i, t := range ts {
+		o.index[t] = i
+		o.done[i] = make(chan struct{})
+	}
+	return o
+}
+
+// wait waits until the templates t depends on are rendered once,
+// it returns false if ctx is done.
+func (o *templateOrder) wait(ctx context.Context, t *TemplateResourceProcessor) bool {
+	if o == nil {
+		return ctx.Err() == nil
+	}
+	i, ok := o.index[t]
+	if !ok {
+		return ctx.Err() == nil
+	}
+
+	for _, j := range o.graph.deps[i] {
+		select {
+		case <-o.done[j]:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// rendered releases the dependents of t.
+func (o *templateOrder) rendered(t *TemplateResourceProcessor) {
+	if o == nil {
+		return
+	}
+	if i, ok := o.index[t]; ok {
+		o.once[i].Do(func() { close(o.done[i]) })
+	}
+}
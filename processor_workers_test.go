@@ -0,0 +1,198 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func tMakeTemplateProcessor(name string, dependsOn ...string) *TemplateResourceProcessor {
+	return &TemplateResourceProcessor{
+		TemplateResource: TemplateResource{DependsOn: dependsOn},
+		path:             filepath.Join("conf.d", name+".toml"),
+	}
+}
+
+func TestNewTemplateGraph(t *testing.T) {
+	ts := []*TemplateResourceProcessor{
+		tMakeTemplateProcessor("a", "b.toml", "unknown"),
+		tMakeTemplateProcessor("b"),
+		tMakeTemplateProcessor("c", "a", "b"),
+	}
+	g, err := newTemplateGraph(ts)
+	tAssert(t, err == nil, err)
+	tAssertf(t, fmt.Sprint(g.deps) == "[[1] [] [0 1]]", "deps = %v", g.deps)
+	tAssertf(t, fmt.Sprint(g.dependents) == "[[2] [0 2] []]", "dependents = %v", g.dependents)
+
+	ts[1].DependsOn = []string{"c"}
+	_, err = newTemplateGraph(ts)
+	tAssert(t, err != nil)
+}
+
+func TestProcessor_concurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	tAssert(t, err == nil, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"templates/test.tmpl": `{{track}}`,
+	}
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("conf.d/t%d.toml", i)] = fmt.Sprintf(`
+			[template]
+			src = "test.tmpl"
+			dest = "%s"
+			keys = ["/"]
+		`, filepath.Join(dir, fmt.Sprintf("t%d.out", i)))
+	}
+	files["conf.d/last.toml"] = fmt.Sprintf(`
+		[template]
+		src = "test.tmpl"
+		dest = "%s"
+		keys = ["/"]
+		depends_on = ["t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7"]
+	`, filepath.Join(dir, "last.out"))
+
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		tAssert(t, os.MkdirAll(filepath.Dir(name), 0755) == nil)
+		tAssert(t, ioutil.WriteFile(name, []byte(content), 0644) == nil)
+	}
+
+	var (
+		mu         sync.Mutex
+		running    int
+		maxRunning int
+		done       []string
+	)
+	track := func() string {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Second / 20)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return "ok"
+	}
+
+	backend := tNewBlockingBackend()
+	close(backend.release)
+
+	cfg := &Config{ConfDir: dir, Interval: 10, Prefix: "/"}
+	err = NewProcessor().Run(cfg, backend,
+		WithOnetimeMode(),
+		WithConcurrency(3),
+		WithFuncMap(template.FuncMap{"track": track}),
+		WithHookOnUpdateDone(func(trName string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, templateName(trName))
+		}),
+	)
+	tAssert(t, err == nil, err)
+
+	tAssert(t, maxRunning > 1 && maxRunning <= 3, maxRunning)
+	tAssert(t, len(done) == 9, done)
+	tAssert(t, done[8] == "last", done)
+}
+
+// tWatchBackend returns the first watch at once, and blocks the others
+// until stopped.
+type tWatchBackend struct{}
+
+func (tWatchBackend) Type() string       { return "libconfd-backend-watch" }
+func (tWatchBackend) WatchEnabled() bool { return true }
+func (tWatchBackend) Close() error       { return nil }
+
+func (tWatchBackend) GetValues(keys []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (tWatchBackend) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	<-stopChan
+	return waitIndex, nil
+}
+
+func TestProcessor_watchDependsOn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libconfd")
+	tAssert(t, err == nil, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"templates/slow.tmpl": `{{sleep}}`,
+		"templates/fast.tmpl": `ok`,
+		"conf.d/base.toml": fmt.Sprintf(`
+			[template]
+			src = "slow.tmpl"
+			dest = "%s"
+			keys = ["/"]
+		`, filepath.Join(dir, "base.out")),
+		"conf.d/app.toml": fmt.Sprintf(`
+			[template]
+			src = "fast.tmpl"
+			dest = "%s"
+			keys = ["/"]
+			depends_on = ["base"]
+		`, filepath.Join(dir, "app.out")),
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		tAssert(t, os.MkdirAll(filepath.Dir(name), 0755) == nil)
+		tAssert(t, ioutil.WriteFile(name, []byte(content), 0644) == nil)
+	}
+
+	var (
+		mu   sync.Mutex
+		done []string
+	)
+	sleep := func() string {
+		time.Sleep(time.Second / 5)
+		return "ok"
+	}
+
+	cfg := &Config{ConfDir: dir, Prefix: "/", Watch: true}
+	call := NewProcessor().Go(cfg, tWatchBackend{},
+		WithConcurrency(2),
+		WithFuncMap(template.FuncMap{"sleep": sleep}),
+		WithHookOnUpdateDone(func(trName string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, templateName(trName))
+		}),
+	)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(done)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second / 20)
+	}
+	call.Cancel()
+	<-call.Done
+
+	mu.Lock()
+	defer mu.Unlock()
+	tAssert(t, len(done) == 2 && done[0] == "base", done)
+}
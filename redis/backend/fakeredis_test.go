@@ -0,0 +1,297 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tFakeRedis is an in-process Redis stand-in, it supports the commands
+// used by RedisClient and publishes keyspace notifications of db 0.
+type tFakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	subs    map[*tFakeRedisConn]string // pattern prefix
+}
+
+type tFakeRedisConn struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func tNewFakeRedis(tb testing.TB, password string) *tFakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	p := &tFakeRedis{
+		ln:       ln,
+		password: password,
+		strings:  make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+		subs:     make(map[*tFakeRedisConn]string),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+
+	return p
+}
+
+func (p *tFakeRedis) Addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *tFakeRedis) Close() {
+	p.ln.Close()
+}
+
+func (p *tFakeRedis) Set(key, value string) {
+	p.mu.Lock()
+	p.strings[key] = value
+	p.mu.Unlock()
+
+	p.publish(key, "set")
+}
+
+func (p *tFakeRedis) HSet(key, field, value string) {
+	p.mu.Lock()
+	if p.hashes[key] == nil {
+		p.hashes[key] = make(map[string]string)
+	}
+	p.hashes[key][field] = value
+	p.mu.Unlock()
+
+	p.publish(key, "hset")
+}
+
+func (p *tFakeRedis) Del(key string) {
+	p.mu.Lock()
+	delete(p.strings, key)
+	delete(p.hashes, key)
+	p.mu.Unlock()
+
+	p.publish(key, "del")
+}
+
+func (p *tFakeRedis) publish(key, event string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	channel := "__keyspace@0__:" + key
+	for c, prefix := range p.subs {
+		if strings.HasPrefix(channel, prefix) {
+			c.write([]interface{}{"pmessage", prefix + "*", channel, event})
+		}
+	}
+}
+
+func (p *tFakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c := &tFakeRedisConn{w: bufio.NewWriter(conn)}
+	defer func() {
+		p.mu.Lock()
+		delete(p.subs, c)
+		p.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	authed := p.password == ""
+
+	for {
+		args, err := tReadRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			c.write(fmt.Errorf("NOAUTH Authentication required."))
+			continue
+		}
+
+		switch cmd {
+		case "AUTH":
+			if len(args) != 2 || args[1] != p.password {
+				c.write(fmt.Errorf("ERR invalid password"))
+				continue
+			}
+			authed = true
+			c.write("OK")
+		case "SELECT", "CONFIG":
+			c.write("OK")
+		case "PING":
+			p.mu.Lock()
+			_, subscribed := p.subs[c]
+			p.mu.Unlock()
+			if subscribed {
+				c.write([]interface{}{"pong", ""})
+			} else {
+				c.write("PONG")
+			}
+		case "SCAN":
+			c.write([]interface{}{"0", p.scan(args)})
+		case "TYPE":
+			c.write(p.typeOf(args[1]))
+		case "GET":
+			p.mu.Lock()
+			v, ok := p.strings[args[1]]
+			p.mu.Unlock()
+			if ok {
+				c.write([]byte(v))
+			} else {
+				c.write(nil)
+			}
+		case "HGETALL":
+			var reply []interface{}
+			p.mu.Lock()
+			for k, v := range p.hashes[args[1]] {
+				reply = append(reply, k, v)
+			}
+			p.mu.Unlock()
+			c.write(reply)
+		case "PSUBSCRIBE":
+			p.mu.Lock()
+			p.subs[c] = strings.TrimSuffix(args[1], "*")
+			p.mu.Unlock()
+			c.write([]interface{}{"psubscribe", args[1], int64(1)})
+		case "PUNSUBSCRIBE":
+			p.mu.Lock()
+			delete(p.subs, c)
+			p.mu.Unlock()
+			c.write([]interface{}{"punsubscribe", "", int64(0)})
+		default:
+			c.write(fmt.Errorf("ERR unknown command '%s'", args[0]))
+		}
+	}
+}
+
+// scan supports "prefix*" patterns only.
+func (p *tFakeRedis) scan(args []string) []interface{} {
+	var prefix string
+	for i := 2; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) == "MATCH" {
+			prefix = strings.TrimSuffix(args[i+1], "*")
+		}
+	}
+	prefix = strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`).Replace(prefix)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var keys []interface{}
+	for k := range p.strings {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range p.hashes {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (p *tFakeRedis) typeOf(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.strings[key]; ok {
+		return "string"
+	}
+	if _, ok := p.hashes[key]; ok {
+		return "hash"
+	}
+	return "none"
+}
+
+func (c *tFakeRedisConn) write(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tWriteRedisValue(c.w, v)
+	c.w.Flush()
+}
+
+func tWriteRedisValue(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case error:
+		w.WriteString("-" + v.Error() + "\r\n")
+	case string:
+		// simple string in reply, bulk string in array
+		w.WriteString("+" + v + "\r\n")
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				x = []byte(s)
+			}
+			tWriteRedisValue(w, x)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported type %T", v))
+	}
+}
+
+func tReadRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil // inline command
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
@@ -0,0 +1,498 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_redis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+
+	"openpitrix.io/libconfd"
+)
+
+var (
+	_ libconfd.BackendClient = (*RedisClient)(nil)
+)
+
+const RedisBackendType = "libconfd-backend-redis"
+
+func init() {
+	libconfd.RegisterBackendClient(
+		RedisBackendType,
+		func(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error) {
+			return NewRedisClient(cfg)
+		},
+	)
+}
+
+var errClientClosed = errors.New("backend_redis: client is closed")
+
+// the default max changed keys saved for WatchPrefix, the older half is
+// pruned when it is exceeded, and the watches from the pruned indexes
+// return at once, since their changes are unknown.
+const defaultMaxModIndex = 4096
+
+// RedisClient reads keys from Redis.
+//
+// String values are read as is, hash fields are flattened into sub keys,
+// so field host of hash /db is the key /db/host, and GetValues of /db/host
+// reads it from the hash.
+// WatchPrefix depends on keyspace notifications, the server must be
+// configured with notify-keyspace-events (at least "K$h").
+//
+// Supported BackendConfig fields:
+//
+//	host = ["127.0.0.1:6379", "127.0.0.1:6380"] # tried in order
+//	password = ""
+//	client_ca_keys/client_cert/client_key       # enable TLS
+//
+//	[options]
+//	db = "0"
+//	scan_count = "100"
+//	notify_keyspace_events = "K$h" # CONFIG SET on watch if not empty
+type RedisClient struct {
+	hosts     []string
+	opt       redis.Options
+	scanCount int64
+	notifyCfg string
+
+	mu      sync.Mutex
+	current int
+	client  *redis.Client
+
+	watchStartMu sync.Mutex
+	pubsub       *redis.PubSub
+	closeChan    chan struct{}
+	closeOnce    sync.Once
+
+	watchMu     sync.Mutex
+	index       uint64
+	modIndex    map[string]uint64   // changed key => index
+	maxModIndex int                 // see defaultMaxModIndex
+	pruned      uint64              // the changes before are pruned
+	watchKeys   map[string]struct{} // the keys of all WatchPrefix calls
+	notify      chan struct{}       // closed and replaced on every change
+
+	hookKeyAdjuster func(key string) (realKey string)
+}
+
+func NewRedisClient(cfg *libconfd.BackendConfig) (*RedisClient, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("backend_redis: empty host")
+	}
+
+	db, err := cfg.GetIntOption("db", 0)
+	if err != nil {
+		return nil, err
+	}
+	scanCount, err := cfg.GetIntOption("scan_count", 100)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &RedisClient{
+		hosts: append([]string{}, cfg.Host...),
+		opt: redis.Options{
+			Password:  cfg.Password,
+			DB:        db,
+			TLSConfig: tlsConfig,
+		},
+		scanCount: int64(scanCount),
+		notifyCfg: cfg.GetOption("notify_keyspace_events", ""),
+
+		closeChan:   make(chan struct{}),
+		index:       1,
+		modIndex:    make(map[string]uint64),
+		maxModIndex: defaultMaxModIndex,
+		watchKeys:   make(map[string]struct{}),
+		notify:      make(chan struct{}),
+
+		hookKeyAdjuster: cfg.HookKeyAdjuster,
+	}
+
+	return p, nil
+}
+
+func (c *RedisClient) Type() string {
+	return RedisBackendType
+}
+
+func (c *RedisClient) WatchEnabled() bool {
+	return true
+}
+
+func (c *RedisClient) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lastErr error
+	if c.pubsub != nil {
+		if err := c.pubsub.Close(); err != nil {
+			lastErr = err
+		}
+		c.pubsub = nil
+	}
+	if c.client != nil {
+		if err := c.client.Close(); err != nil {
+			lastErr = err
+		}
+		c.client = nil
+	}
+	return lastErr
+}
+
+func (c *RedisClient) isClosed() bool {
+	select {
+	case <-c.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// getClient returns the client of current host.
+func (c *RedisClient) getClient() (*redis.Client, error) {
+	if c.isClosed() {
+		return nil, errClientClosed
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		opt := c.opt
+		opt.Addr = c.hosts[c.current]
+		c.client = redis.NewClient(&opt)
+	}
+	return c.client, nil
+}
+
+// nextHost closes the client of current host if it is still x,
+// the next getClient will use the next host.
+func (c *RedisClient) nextHost(x *redis.Client, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != x || len(c.hosts) == 1 {
+		return
+	}
+
+	libconfd.GetLogger().Warningf("backend_redis: %s failed: %v", c.hosts[c.current], err)
+
+	c.client.Close()
+	c.client = nil
+	c.current = (c.current + 1) % len(c.hosts)
+}
+
+// GetValues queries redis for keys prefixed by keys.
+func (c *RedisClient) GetValues(keys []string) (map[string]string, error) {
+	if c.hookKeyAdjuster != nil {
+		realKeys := make([]string, len(keys))
+		for i, key := range keys {
+			realKeys[i] = c.hookKeyAdjuster(key)
+		}
+		keys = realKeys
+	}
+
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	for _, key := range keys {
+		if err := c.getValues(client, key, vars); err != nil {
+			if isNetworkError(err) {
+				c.nextHost(client, err)
+			}
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+// getValues reads the keys prefixed by prefix, and the fields of the
+// ancestor hashes of prefix, such as field host of hash /db for /db/host.
+func (c *RedisClient) getValues(client *redis.Client, prefix string, vars map[string]string) error {
+	for parent := path.Dir(prefix); parent != "/" && parent != "."; parent = path.Dir(parent) {
+		if err := c.getHashValues(client, parent, prefix, vars); err != nil {
+			return err
+		}
+	}
+
+	var cursor uint64
+	for {
+		matched, next, err := client.Scan(cursor, escapePattern(prefix)+"*", c.scanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range matched {
+			if !libconfd.KeyHasPrefix(key, prefix) {
+				continue
+			}
+			if err := c.getValue(client, key, vars); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (c *RedisClient) getValue(client *redis.Client, key string, vars map[string]string) error {
+	typ, err := client.Type(key).Result()
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case "string":
+		s, err := client.Get(key).Result()
+		if err == redis.Nil {
+			return nil // deleted
+		}
+		if err != nil {
+			return err
+		}
+		vars[key] = s
+	case "hash":
+		m, err := client.HGetAll(key).Result()
+		if err != nil {
+			return err
+		}
+		for field, s := range m {
+			vars[strings.TrimSuffix(key, "/")+"/"+field] = s
+		}
+	case "none":
+		// deleted
+	default:
+		libconfd.GetLogger().Debugf("backend_redis: skip key %q of type %s", key, typ)
+	}
+	return nil
+}
+
+// getHashValues reads the fields of hash key which are prefixed by prefix,
+// key is skipped if it is not a hash.
+func (c *RedisClient) getHashValues(client *redis.Client, key, prefix string, vars map[string]string) error {
+	typ, err := client.Type(key).Result()
+	if err != nil {
+		return err
+	}
+	if typ != "hash" {
+		return nil
+	}
+
+	m, err := client.HGetAll(key).Result()
+	if err != nil {
+		return err
+	}
+	for field, s := range m {
+		if k := key + "/" + field; libconfd.KeyHasPrefix(k, prefix) {
+			vars[k] = s
+		}
+	}
+	return nil
+}
+
+// WatchPrefix waits until a key under keys is changed.
+//
+// A single keyspace subscription is shared by all WatchPrefix calls, so
+// changes between two calls are not lost. Only the changes of the keys
+// watched by any call are saved.
+func (c *RedisClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	if c.hookKeyAdjuster != nil {
+		keys = append([]string{}, keys...)
+		for i, key := range keys {
+			keys[i] = c.hookKeyAdjuster(key)
+		}
+	}
+
+	c.watchMu.Lock()
+	for _, key := range keys {
+		c.watchKeys[key] = struct{}{}
+	}
+	c.watchMu.Unlock()
+
+	if err := c.startWatch(); err != nil {
+		return waitIndex, err
+	}
+
+	for {
+		c.watchMu.Lock()
+		index, changed := c.changedSince(keys, waitIndex)
+		notify := c.notify
+		c.watchMu.Unlock()
+
+		// return something > 0 to trigger a key retrieval from the store
+		if waitIndex == 0 || changed {
+			return index, nil
+		}
+
+		select {
+		case <-notify:
+			// check again
+		case <-stopChan:
+			return waitIndex, nil
+		case <-c.closeChan:
+			return waitIndex, errClientClosed
+		}
+	}
+}
+
+func (c *RedisClient) startWatch() error {
+	c.watchStartMu.Lock()
+	defer c.watchStartMu.Unlock()
+
+	c.mu.Lock()
+	started := c.pubsub != nil
+	c.mu.Unlock()
+	if started {
+		return nil
+	}
+
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	if c.notifyCfg != "" {
+		if err := client.ConfigSet("notify-keyspace-events", c.notifyCfg).Err(); err != nil {
+			return err
+		}
+	}
+
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", c.opt.DB)
+
+	pubsub := client.PSubscribe(channelPrefix + "*")
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		if isNetworkError(err) {
+			c.nextHost(client, err)
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	c.pubsub = pubsub
+	c.mu.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			key := strings.TrimPrefix(msg.Channel, channelPrefix)
+			libconfd.GetLogger().Debugf("backend_redis: key %s %s", key, msg.Payload)
+			c.keyChanged(key)
+		}
+
+		// the client is closed or switched to another host,
+		// events may be lost, so wake up all watchers to resync.
+		c.mu.Lock()
+		if c.pubsub == pubsub {
+			c.pubsub = nil
+		}
+		c.mu.Unlock()
+
+		c.keyChanged("/")
+	}()
+
+	return nil
+}
+
+// keyChanged saves the change of key if it is watched, "/" wakes up all
+// watchers.
+func (c *RedisClient) keyChanged(key string) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	if key != "/" && !c.isWatched(key) {
+		return
+	}
+
+	c.index++
+	c.modIndex[key] = c.index
+
+	if len(c.modIndex) > c.maxModIndex {
+		c.pruned = c.index - uint64(c.maxModIndex/2)
+		for k, idx := range c.modIndex {
+			if idx <= c.pruned {
+				delete(c.modIndex, k)
+			}
+		}
+	}
+
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// isWatched reports whether key is related to the watched keys.
+// The caller must hold c.watchMu.
+func (c *RedisClient) isWatched(key string) bool {
+	for prefix := range c.watchKeys {
+		// hash key is the parent of the watched keys
+		if libconfd.KeyHasPrefix(key, prefix) || libconfd.KeyHasPrefix(prefix, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedSince returns the current index, and reports whether any key
+// related to keys changed after waitIndex. The caller must hold c.watchMu.
+func (c *RedisClient) changedSince(keys []string, waitIndex uint64) (uint64, bool) {
+	if waitIndex < c.pruned {
+		return c.index, true
+	}
+	for k, idx := range c.modIndex {
+		if idx <= waitIndex {
+			continue
+		}
+		for _, prefix := range keys {
+			// hash key is the parent of the watched keys
+			if libconfd.KeyHasPrefix(k, prefix) || libconfd.KeyHasPrefix(prefix, k) {
+				return c.index, true
+			}
+		}
+	}
+	return c.index, false
+}
+
+// escapePattern escapes the glob-style pattern characters of SCAN MATCH.
+func escapePattern(s string) string {
+	var replacer = strings.NewReplacer(
+		`\`, `\\`,
+		`*`, `\*`,
+		`?`, `\?`,
+		`[`, `\[`,
+		`]`, `\]`,
+	)
+	return replacer.Replace(s)
+}
+
+func isNetworkError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_redis
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+func TestRedisClient_GetValues(t *testing.T) {
+	server := tNewFakeRedis(t, "123456")
+	defer server.Close()
+
+	server.Set("/key", "foobar")
+	server.Set("/db/host", "127.0.0.1")
+	server.Set("/dbx/host", "skip")
+	server.HSet("/db/pool", "size", "10")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     RedisBackendType,
+		Host:     []string{server.Addr()},
+		Password: "123456",
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/db/host":      "127.0.0.1",
+		"/db/pool/size": "10",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+}
+
+func TestRedisClient_parentHash(t *testing.T) {
+	server := tNewFakeRedis(t, "")
+	defer server.Close()
+
+	server.HSet("/db", "host", "127.0.0.1")
+	server.HSet("/db", "hostx", "skip")
+	server.HSet("/db", "pool/size", "10")
+	server.Set("/app", "not a hash")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: RedisBackendType,
+		Host: []string{server.Addr()},
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db/host", "/db/pool/size", "/app/name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/db/host":      "127.0.0.1",
+		"/db/pool/size": "10",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+}
+
+func TestRedisClient_password(t *testing.T) {
+	server := tNewFakeRedis(t, "123456")
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     RedisBackendType,
+		Host:     []string{server.Addr()},
+		Password: "bad",
+	})
+	defer c.Close()
+
+	if _, err := c.GetValues([]string{"/"}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestRedisClient_failover(t *testing.T) {
+	server := tNewFakeRedis(t, "")
+	defer server.Close()
+
+	server.Set("/key", "foobar")
+
+	// closed port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badAddr := ln.Addr().String()
+	ln.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: RedisBackendType,
+		Host: []string{badAddr, server.Addr()},
+	})
+	defer c.Close()
+
+	if _, err := c.GetValues([]string{"/"}); err == nil {
+		t.Fatal("expect error")
+	}
+
+	m, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["/key"] != "foobar" {
+		t.Fatal(m)
+	}
+}
+
+func TestRedisClient_WatchPrefix(t *testing.T) {
+	server := tNewFakeRedis(t, "")
+	defer server.Close()
+
+	server.Set("/db/host", "127.0.0.1")
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type: RedisBackendType,
+		Host: []string{server.Addr()},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	keys := []string{"/db/host", "/db/pool/size"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(waitIndex uint64) chan uint64 {
+		ch := make(chan uint64, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", keys, waitIndex, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- index
+		}()
+		return ch
+	}
+	expectWakeup := func(ch chan uint64) {
+		t.Helper()
+		select {
+		case newIndex := <-ch:
+			if newIndex <= index {
+				t.Fatalf("index = %d, last = %d", newIndex, index)
+			}
+			index = newIndex
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// other key
+	ch := watch(index)
+	server.Set("/dbx/host", "127.0.0.1")
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(time.Second / 2):
+	}
+
+	server.Set("/db/host", "10.0.0.1")
+	expectWakeup(ch)
+
+	// hash field
+	ch = watch(index)
+	server.HSet("/db/pool", "size", "10")
+	expectWakeup(ch)
+
+	// changed before the watch call
+	server.Del("/db/host")
+	time.Sleep(time.Second / 10)
+	expectWakeup(watch(index))
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+	select {
+	case newIndex := <-ch:
+		if newIndex != index {
+			t.Fatalf("index = %d, last = %d", newIndex, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestRedisClient_modIndex(t *testing.T) {
+	server := tNewFakeRedis(t, "")
+	defer server.Close()
+
+	c, err := NewRedisClient(&libconfd.BackendConfig{
+		Type: RedisBackendType,
+		Host: []string{server.Addr()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.maxModIndex = 4
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	keys := []string{"/db"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys not watched are not saved
+	for i := 0; i < 10; i++ {
+		server.Set(fmt.Sprintf("/tmp/%d", i), "1")
+	}
+	for i := 0; i < 10; i++ {
+		server.Set(fmt.Sprintf("/db/%d", i), "1")
+	}
+	time.Sleep(time.Second / 10)
+
+	c.watchMu.Lock()
+	n := len(c.modIndex)
+	c.watchMu.Unlock()
+	if n > c.maxModIndex {
+		t.Fatalf("len(modIndex) = %d", n)
+	}
+
+	// the changes after index are pruned
+	ch := make(chan uint64, 1)
+	go func() {
+		newIndex, _ := c.WatchPrefix("/", keys, index, stopChan)
+		ch <- newIndex
+	}()
+	select {
+	case newIndex := <-ch:
+		if newIndex <= index {
+			t.Fatalf("index = %d, last = %d", newIndex, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
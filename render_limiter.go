@@ -0,0 +1,88 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"time"
+)
+
+// the max wait of debounce is debounceMaxWaitFactor times of debounce,
+// so a template is still rendered if the keys never stop changing.
+const debounceMaxWaitFactor = 10
+
+// renderLimiter schedules the renders of a template in watch mode.
+//
+// The changes are coalesced until no change comes for debounce, and
+// two renders are at least minInterval apart. The changes during a
+// render are coalesced into the next render.
+type renderLimiter struct {
+	debounce    time.Duration
+	minInterval time.Duration
+
+	pending     bool
+	firstChange time.Time // first change since the last render
+	lastRender  time.Time
+	timer       *time.Timer
+}
+
+// newRenderLimiter returns the limiter of t, the settings of t override
+// the settings of cfg.
+func newRenderLimiter(cfg *Config, t *TemplateResourceProcessor) *renderLimiter {
+	debounce := cfg.GetDebounce()
+	if t.Debounce > 0 {
+		debounce = time.Duration(t.Debounce) * time.Millisecond
+	}
+	minInterval := cfg.GetMinReloadInterval()
+	if t.MinReloadInterval > 0 {
+		minInterval = time.Duration(t.MinReloadInterval) * time.Second
+	}
+
+	return &renderLimiter{
+		debounce:    debounce,
+		minInterval: minInterval,
+	}
+}
+
+// C returns the channel which fires when the pending changes should be
+// rendered, or nil if there is no pending change.
+func (p *renderLimiter) C() <-chan time.Time {
+	if !p.pending {
+		return nil
+	}
+	return p.timer.C
+}
+
+// Changed schedules a render of the changes.
+func (p *renderLimiter) Changed() {
+	now := time.Now()
+	if !p.pending {
+		p.pending = true
+		p.firstChange = now
+	}
+
+	at := now.Add(p.debounce)
+	if maxWait := p.firstChange.Add(p.debounce * debounceMaxWaitFactor); at.After(maxWait) {
+		at = maxWait
+	}
+	if next := p.lastRender.Add(p.minInterval); at.Before(next) {
+		at = next
+	}
+
+	p.Stop()
+	p.timer = time.NewTimer(time.Until(at))
+}
+
+// Rendered clears the pending changes, it is called after each render.
+func (p *renderLimiter) Rendered() {
+	p.Stop()
+	p.pending = false
+	p.lastRender = time.Now()
+}
+
+func (p *renderLimiter) Stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package libconfd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRenderLimiter(t *testing.T) {
+	p := &renderLimiter{debounce: time.Second / 10}
+	defer p.Stop()
+
+	tAssert(t, p.C() == nil)
+
+	// debounce
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		p.Changed()
+		time.Sleep(time.Second / 20)
+	}
+	<-p.C()
+	d := time.Since(start)
+	tAssert(t, d >= time.Second*19/100, d)
+
+	p.Rendered()
+	tAssert(t, p.C() == nil)
+
+	// max wait
+	start = time.Now()
+	for fired := false; !fired; {
+		p.Changed()
+		select {
+		case <-p.C():
+			fired = true
+		case <-time.After(time.Second / 50):
+		}
+		tAssert(t, time.Since(start) < 5*time.Second, "debounce never fires")
+	}
+	d = time.Since(start)
+	tAssert(t, d >= time.Second && d < 2*time.Second, d)
+	p.Rendered()
+
+	// min interval
+	p = &renderLimiter{minInterval: time.Second / 5}
+	p.Rendered()
+
+	start = time.Now()
+	p.Changed()
+	<-p.C()
+	d = time.Since(start)
+	tAssert(t, d >= time.Second*15/100, d)
+}
+
+func TestProcessor_debounce(t *testing.T) {
+	cfg := tMakeConfDir(t, `{{getv "/a/x"}}`, "/a")
+	defer os.RemoveAll(cfg.ConfDir)
+
+	name := filepath.Join(cfg.ConfDir, "backend.toml")
+	tWriteFile(t, name, `"/a/x" = "0"`)
+
+	backend := NewTomlBackendClient(&BackendConfig{Type: TomlBackendType, Host: []string{name}})
+	defer backend.Close()
+
+	p := NewProcessor()
+	defer p.Close()
+
+	call := p.Go(cfg, backend, WithWatchMode(), WithDebounce(500))
+
+	// bulk update
+	for i := 1; i <= 10; i++ {
+		tWriteFile(t, name, `"/a/x" = "`+strconv.Itoa(i)+`"`)
+		time.Sleep(time.Second / 50)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(filepath.Join(cfg.ConfDir, "test.out"))
+		if string(data) == "10" {
+			break
+		}
+		tAssertf(t, time.Now().Before(deadline), "got = %q", data)
+		time.Sleep(time.Second / 10)
+	}
+
+	results := call.Results()
+	tAssert(t, len(results) == 1 && results[0].Runs <= 2, results)
+}
@@ -34,6 +34,15 @@ type TemplateResource struct {
 	ReloadCmd     string      `toml:"reload_cmd" json:"reload_cmd"`
 	FileMode      os.FileMode `toml:"file_mode" json:"file_mode"`
 	PGPPrivateKey []byte      `toml:"pgp_private_key" json:"pgp_private_key"`
+
+	// the template resources processed before this one, named by the
+	// config file without ".toml"; in watch mode only the first render
+	// waits for them
+	DependsOn []string `toml:"depends_on" json:"depends_on"`
+
+	// watch mode settings, 0 means the setting of Config
+	Debounce          int `toml:"debounce" json:"debounce"`                       // milliseconds
+	MinReloadInterval int `toml:"min_reload_interval" json:"min_reload_interval"` // seconds
 }
 
 var _LIBCONFD_GOOS = func() string {
@@ -6,23 +6,26 @@ package libconfd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type TemplateResourceProcessor struct {
 	TemplateResource
 
 	path          string
-	client        BackendClient
+	client        BackendClientV2
 	store         *KVStore
 	stageFile     *os.File
 	templateFunc  *TemplateFunc
@@ -72,7 +75,7 @@ func NewTemplateResourceProcessor(
 	}
 
 	tr.path = path
-	tr.client = client
+	tr.client = ToBackendClientV2(client)
 	tr.store = NewKVStore()
 	tr.keepStageFile = config.KeepStageFile
 	tr.syncOnly = config.SyncOnly
@@ -127,9 +130,101 @@ func NewTemplateResourceProcessor(
 // things up.
 // It returns an error if any.
 func (p *TemplateResourceProcessor) Process(call *Call) (err error) {
+	return p.ProcessContext(call.getContext(), call)
+}
+
+// ProcessContext is like Process, the backend requests are stopped when
+// ctx is done, and time out after call.Config.GetBackendTimeout().
+func (p *TemplateResourceProcessor) ProcessContext(ctx context.Context, call *Call) (err error) {
+	if fn := call.Config.HookOnUpdateDone; fn != nil {
+		defer func() { fn(p.path, err) }()
+	}
+	defer func(start time.Time) { call.setResult(p.path, start, err) }(time.Now())
+
+	if err := p.setVars(ctx, call); err != nil {
+		GetLogger().Error(err)
+		return err
+	}
+	return p.render(call)
+}
+
+// update renders the template with the values in the store, it is used
+// after the events are applied by applyEvents.
+func (p *TemplateResourceProcessor) update(call *Call) (err error) {
 	if fn := call.Config.HookOnUpdateDone; fn != nil {
 		defer func() { fn(p.path, err) }()
 	}
+	defer func(start time.Time) { call.setResult(p.path, start, err) }(time.Now())
+
+	return p.render(call)
+}
+
+// applyEvents applies the events of the keys of the template resource
+// to the store, and reports whether the store is changed.
+//
+// The event keys are adjusted by the backend, so the keys are filtered
+// with the KeyAdjuster of the backend too.
+func (p *TemplateResourceProcessor) applyEvents(call *Call, batch EventBatch) bool {
+	absKeys := p.getAbsKeys()
+	if fn := call.Config.HookAbsKeyAdjuster; fn != nil {
+		for i, key := range absKeys {
+			absKeys[i] = fn(key)
+		}
+	}
+	if a, ok := toKeyAdjuster(call.Client); ok {
+		for i, key := range absKeys {
+			absKeys[i] = a.AdjustKey(key)
+		}
+	}
+
+	isWatched := func(key string) bool {
+		for _, k := range absKeys {
+			if KeyHasPrefix(key, k) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var oldValues map[string]string
+	if batch.Reset {
+		oldValues = p.store.values()
+		p.store.Purge()
+	}
+	defer p.store.SetRevision(batch.Revision)
+
+	var changed bool
+	for _, ev := range batch.Events {
+		if !isWatched(ev.Key) {
+			continue
+		}
+
+		switch ev.Type {
+		case EventPut:
+			if v, ok := p.store.GetValue(ev.Key); !ok || v != ev.NewValue {
+				p.store.Set(ev.Key, ev.NewValue)
+				changed = true
+			}
+		case EventDelete:
+			if p.store.Exists(ev.Key) {
+				p.store.Del(ev.Key)
+				changed = true
+			}
+		}
+	}
+
+	if batch.Reset {
+		changed = !reflect.DeepEqual(oldValues, p.store.values())
+	}
+	return changed
+}
+
+// render renders the template with the values in the store, and syncs
+// the dest file.
+func (p *TemplateResourceProcessor) render(call *Call) error {
+	if fn := call.Config.HookOnSnapshot; fn != nil {
+		fn(p.path, p.store.Revision())
+	}
 
 	if len(call.Config.FuncMap) > 0 {
 		for k, fn := range call.Config.FuncMap {
@@ -144,10 +239,6 @@ func (p *TemplateResourceProcessor) Process(call *Call) (err error) {
 		GetLogger().Error(err)
 		return err
 	}
-	if err := p.setVars(call); err != nil {
-		GetLogger().Error(err)
-		return err
-	}
 	if err := p.createStageFile(call); err != nil {
 		GetLogger().Error(err)
 		return err
@@ -178,7 +269,7 @@ func (p *TemplateResourceProcessor) setFileMode(call *Call) error {
 }
 
 // setVars sets the Vars for template resource.
-func (p *TemplateResourceProcessor) setVars(call *Call) error {
+func (p *TemplateResourceProcessor) setVars(ctx context.Context, call *Call) error {
 	GetLogger().Debugln("prefix:", p.Prefix)
 
 	absKeys := p.getAbsKeys()
@@ -194,18 +285,30 @@ func (p *TemplateResourceProcessor) setVars(call *Call) error {
 
 	GetLogger().Debugf("GetValues: absKeys1 = %#v\n", absKeys)
 
-	values, err := p.client.GetValues(absKeys)
+	ctx, cancel := context.WithTimeout(ctx, call.Config.GetBackendTimeout())
+	defer cancel()
+
+	var values map[string]string
+	var revision uint64
+	var err error
+
+	if r, ok := toSnapshotReader(p.client); ok {
+		values, revision, err = r.GetSnapshot(ctx, absKeys)
+	} else {
+		values, err = p.client.GetValuesContext(ctx, absKeys)
+	}
 	if err != nil {
 		return err
 	}
 
-	GetLogger().Debugf("GetValues: %#v\n", values)
+	GetLogger().Debugf("GetValues: %#v, revision: %d\n", values, revision)
 
 	p.store.Purge()
 	for k, v := range values {
 		//p.store.Set(path.Join("/", strings.TrimPrefix(k, p.Prefix)), v)
 		p.store.Set(k, v)
 	}
+	p.store.SetRevision(revision)
 
 	return nil
 }
@@ -342,6 +445,7 @@ func (p *TemplateResourceProcessor) doCheckCmd(call *Call) (err error) {
 	var cmdBuffer bytes.Buffer
 	data := make(map[string]string)
 	data["src"] = p.stageFile.Name()
+	data["revision"] = strconv.FormatUint(p.store.Revision(), 10)
 	tmpl, err := template.New("checkcmd").Parse(p.CheckCmd)
 	if err != nil {
 		return err
@@ -365,8 +469,9 @@ func (p *TemplateResourceProcessor) doReloadCmd(call *Call) (err error) {
 // runCommand is a shared function used by check and reload
 // to run the given command and log its output.
 // It returns nil if the given cmd returns 0.
-// The command can be run on unix and windows.
-func (_ *TemplateResourceProcessor) runCommand(cmd string) error {
+// The command can be run on unix and windows, the revision of the values
+// is passed in the LIBCONFD_REVISION environment variable.
+func (p *TemplateResourceProcessor) runCommand(cmd string) error {
 	cmd = strings.TrimSpace(cmd)
 
 	GetLogger().Debug("TemplateResourceProcessor.runCommand: " + cmd)
@@ -383,6 +488,9 @@ func (_ *TemplateResourceProcessor) runCommand(cmd string) error {
 	} else {
 		c = exec.Command("/bin/sh", "-c", cmd)
 	}
+	c.Env = append(os.Environ(),
+		"LIBCONFD_REVISION="+strconv.FormatUint(p.store.Revision(), 10),
+	)
 
 	output, err := c.CombinedOutput()
 	if err != nil {
@@ -0,0 +1,362 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_sql
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+var (
+	_ libconfd.BackendClient   = (*SqlClient)(nil)
+	_ libconfd.BackendClientV2 = (*SqlClient)(nil)
+)
+
+const SqlBackendType = "libconfd-backend-sql"
+
+func init() {
+	libconfd.RegisterBackendClient(
+		SqlBackendType,
+		func(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error) {
+			return NewSqlClient(cfg)
+		},
+	)
+}
+
+// table and column names are not quoted, only plain names are allowed
+var reIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// SqlClient reads keys from a key/value table with database/sql.
+//
+// The key column holds the full key, such as /db/host. The driver must be
+// registered by the program, e.g. by importing github.com/mattn/go-sqlite3.
+//
+// WatchPrefix polls the table every poll_interval. If version_column is
+// set, only COUNT(*) and MAX(version_column) of the watched rows are
+// queried, the column may be an increasing version or an updated_at
+// timestamp. Otherwise the watched rows are read and compared.
+//
+// Polling has limits, the changes are missed if:
+//
+//   - the rows are changed and changed back between two polls, the
+//     checksum of the rows is the same;
+//   - with version_column, a row is deleted and another row is inserted
+//     between two polls, and the new row has a version not greater than
+//     the max version, e.g. a copied version or a timestamp of the same
+//     second; COUNT(*) and MAX are the same;
+//   - with version_column, a row is updated without increasing its
+//     version column.
+//
+// Use version_column only if every insert and update sets a new max
+// version, such as a sequence or a trigger.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["file:/var/lib/app/config.db"]  # data source name
+//
+//	[options]
+//	driver = "sqlite3"                      # required
+//	table = "libconfd"
+//	key_column = "name"
+//	value_column = "value"
+//	version_column = ""                     # e.g. "version" or "updated_at"
+//	placeholder = "?"                       # "?" or "$" for $1, $2, ...
+//	poll_interval = "5s"
+//	request_timeout = "10s"                 # used if the context has no deadline
+type SqlClient struct {
+	db *sql.DB
+
+	table          string
+	keyColumn      string
+	valueColumn    string
+	versionColumn  string
+	placeholder    string
+	pollInterval   time.Duration
+	requestTimeout time.Duration
+
+	// state of the last watch of each key set, used to detect the
+	// changes between two watch calls.
+	watchMu    sync.Mutex
+	watchState map[string]sqlWatchState
+
+	hookKeyAdjuster func(key string) (realKey string)
+}
+
+type sqlWatchState struct {
+	index   uint64
+	version string
+}
+
+func NewSqlClient(cfg *libconfd.BackendConfig) (*SqlClient, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("backend_sql: empty host")
+	}
+
+	driver := cfg.GetOption("driver", "")
+	if driver == "" {
+		return nil, fmt.Errorf("backend_sql: empty driver")
+	}
+
+	p := &SqlClient{
+		table:         cfg.GetOption("table", "libconfd"),
+		keyColumn:     cfg.GetOption("key_column", "name"),
+		valueColumn:   cfg.GetOption("value_column", "value"),
+		versionColumn: cfg.GetOption("version_column", ""),
+		placeholder:   cfg.GetOption("placeholder", "?"),
+
+		watchState: make(map[string]sqlWatchState),
+
+		hookKeyAdjuster: cfg.HookKeyAdjuster,
+	}
+
+	var err error
+	if p.pollInterval, err = cfg.GetDurationOption("poll_interval", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if p.requestTimeout, err = cfg.GetDurationOption("request_timeout", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if p.pollInterval <= 0 || p.requestTimeout <= 0 {
+		return nil, fmt.Errorf("backend_sql: poll_interval and request_timeout must be positive")
+	}
+
+	for _, name := range []string{p.table, p.keyColumn, p.valueColumn} {
+		if !reIdentifier.MatchString(name) {
+			return nil, fmt.Errorf("backend_sql: invalid identifier %q", name)
+		}
+	}
+	if p.versionColumn != "" && !reIdentifier.MatchString(p.versionColumn) {
+		return nil, fmt.Errorf("backend_sql: invalid identifier %q", p.versionColumn)
+	}
+	if p.placeholder != "?" && p.placeholder != "$" {
+		return nil, fmt.Errorf("backend_sql: invalid placeholder %q", p.placeholder)
+	}
+
+	if p.db, err = sql.Open(driver, cfg.Host[0]); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (c *SqlClient) Type() string {
+	return SqlBackendType
+}
+
+func (c *SqlClient) WatchEnabled() bool {
+	return true
+}
+
+func (c *SqlClient) Close() error {
+	return c.db.Close()
+}
+
+// GetValues queries the rows of keys prefixed by keys.
+func (c *SqlClient) GetValues(keys []string) (map[string]string, error) {
+	return c.GetValuesContext(context.Background(), keys)
+}
+
+// GetValuesContext queries the rows of keys prefixed by keys.
+// If ctx has no deadline, the query times out after request_timeout.
+func (c *SqlClient) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
+	keys = c.adjustKeys(keys)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+
+	where, args := c.whereKeys(keys)
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s",
+		c.keyColumn, c.valueColumn, c.table, where,
+	)
+
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return vars, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k string
+		var v sql.NullString
+		if err := rows.Scan(&k, &v); err != nil {
+			return vars, err
+		}
+		vars[k] = v.String
+	}
+	return vars, rows.Err()
+}
+
+func (c *SqlClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	index, err := c.Watch(ctx, prefix, keys, waitIndex)
+	if err != nil && ctx.Err() != nil {
+		return index, nil // stopped
+	}
+	return index, err
+}
+
+// Watch polls the rows of keys prefixed by keys until they are changed
+// after waitIndex. It returns ctx.Err() when ctx is done.
+//
+// The index counts the changes seen by the watches of the same keys, it
+// is only increased, so every caller with an older waitIndex returns the
+// new index, and a change between two calls is returned by the next call.
+func (c *SqlClient) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	keys = c.adjustKeys(keys)
+
+	stateKey := strings.Join(keys, "\x00")
+
+	for {
+		version, err := c.getVersion(ctx, keys)
+		if err != nil {
+			if ctx.Err() != nil {
+				return waitIndex, ctx.Err()
+			}
+			return waitIndex, err
+		}
+
+		c.watchMu.Lock()
+		state, ok := c.watchState[stateKey]
+		if !ok {
+			state = sqlWatchState{index: 1, version: version}
+		} else if state.version != version {
+			state = sqlWatchState{index: state.index + 1, version: version}
+		}
+		c.watchState[stateKey] = state
+		c.watchMu.Unlock()
+
+		// return something > 0 to trigger a key retrieval from the store
+		if waitIndex == 0 || waitIndex != state.index {
+			return state.index, nil
+		}
+
+		select {
+		case <-time.After(c.pollInterval):
+		case <-ctx.Done():
+			return waitIndex, ctx.Err()
+		}
+	}
+}
+
+// getVersion returns a string which is changed when any row of keys
+// prefixed by keys is changed.
+func (c *SqlClient) getVersion(ctx context.Context, keys []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	defer cancel()
+
+	if c.versionColumn == "" {
+		values, err := c.GetValuesContext(ctx, keys)
+		if err != nil {
+			return "", err
+		}
+		return valuesChecksum(values), nil
+	}
+
+	where, args := c.whereKeys(keys)
+	query := fmt.Sprintf("SELECT COUNT(*), MAX(%s) FROM %s WHERE %s",
+		c.versionColumn, c.table, where,
+	)
+
+	var count int64
+	var maxVersion sql.NullString
+	if err := c.db.QueryRowContext(ctx, query, args...).Scan(&count, &maxVersion); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(count, 10) + ":" + maxVersion.String, nil
+}
+
+// whereKeys returns the condition of keys prefixed by keys, and its args.
+func (c *SqlClient) whereKeys(keys []string) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	for _, key := range keys {
+		key = strings.TrimSuffix(key, "/")
+		if key == "" {
+			// the root prefix matches all keys
+			return "1 = 1", nil
+		}
+
+		conds = append(conds, fmt.Sprintf(`(%s = %s OR %s LIKE %s ESCAPE '!')`,
+			c.keyColumn, c.bindVar(len(args)+1),
+			c.keyColumn, c.bindVar(len(args)+2),
+		))
+		args = append(args, key, escapeLike(key)+"/%")
+	}
+
+	return strings.Join(conds, " OR "), args
+}
+
+// bindVar returns the placeholder of the n-th arg, starting from 1.
+func (c *SqlClient) bindVar(n int) string {
+	if c.placeholder == "$" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+func (c *SqlClient) adjustKeys(keys []string) []string {
+	if c.hookKeyAdjuster == nil {
+		return keys
+	}
+	var realKeys []string
+	for _, key := range keys {
+		realKeys = append(realKeys, c.hookKeyAdjuster(key))
+	}
+	return realKeys
+}
+
+// escapeLike escapes the wildcards of LIKE pattern with '!', not '\',
+// since the backslash escapes the quote in the string literals of MySQL.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`).Replace(s)
+}
+
+// valuesChecksum returns the checksum of values.
+func valuesChecksum(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha1.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%q\n", k, values[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_sql
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"openpitrix.io/libconfd"
+)
+
+// tSqliteDB is a temporary SQLite database with the table
+// libconfd(name, value, version).
+type tSqliteDB struct {
+	dir string
+	dsn string
+	db  *sql.DB
+}
+
+func tNewSqliteDB(tb testing.TB) *tSqliteDB {
+	tb.Helper()
+
+	dir, err := ioutil.TempDir("", "libconfd-sql")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	dsn := "file:" + filepath.Join(dir, "config.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+
+	p := &tSqliteDB{dir: dir, dsn: dsn, db: db}
+	p.Exec(tb, `CREATE TABLE libconfd (name TEXT PRIMARY KEY, value TEXT, version INTEGER)`)
+	return p
+}
+
+func (p *tSqliteDB) Exec(tb testing.TB, query string, args ...interface{}) {
+	tb.Helper()
+
+	if _, err := p.db.Exec(query, args...); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func (p *tSqliteDB) Set(tb testing.TB, key, value string) {
+	tb.Helper()
+
+	p.Exec(tb, `INSERT OR REPLACE INTO libconfd (name, value, version)
+		VALUES (?, ?, (SELECT COALESCE(MAX(version), 0) + 1 FROM libconfd))`,
+		key, value,
+	)
+}
+
+func (p *tSqliteDB) Close() {
+	p.db.Close()
+	os.RemoveAll(p.dir)
+}
+
+func tNewSqlClient(tb testing.TB, dsn string, options map[string]string) libconfd.BackendClient {
+	tb.Helper()
+
+	opts := map[string]string{"driver": "sqlite3"}
+	for k, v := range options {
+		opts[k] = v
+	}
+
+	c, err := libconfd.NewBackendClient(&libconfd.BackendConfig{
+		Type:    SqlBackendType,
+		Host:    []string{dsn},
+		Options: opts,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestSqlClient_GetValues(t *testing.T) {
+	db := tNewSqliteDB(t)
+	defer db.Close()
+
+	db.Set(t, "/db", "root")
+	db.Set(t, "/db/host", "127.0.0.1")
+	db.Set(t, "/db/port", "3306")
+	db.Set(t, "/dbx/host", "10.0.0.1")
+	db.Set(t, "/d_/x", "wildcard")
+	db.Set(t, "/key", "foobar")
+
+	c := tNewSqlClient(t, db.dsn, nil)
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/db/", "/d_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/db":      "root",
+		"/db/host": "127.0.0.1",
+		"/db/port": "3306",
+		"/d_/x":    "wildcard",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	m, err = c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 6 {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	// the wildcards and the escape character are matched as is
+	db.Set(t, "/p%_!/x", "escaped")
+	db.Set(t, "/pab!/x", "skip")
+	db.Set(t, "/p%_!!/x", "skip")
+
+	m, err = c.GetValues([]string{"/p%_!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = map[string]string{"/p%_!/x": "escaped"}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if s := escapeLike("/a%b_c!d"); s != "/a!%b!_c!!d" {
+		t.Fatal(s)
+	}
+}
+
+func TestSqlClient_invalid(t *testing.T) {
+	for _, options := range []map[string]string{
+		{},
+		{"driver": "sqlite3", "table": "t; DROP TABLE t"},
+		{"driver": "sqlite3", "placeholder": ":"},
+		{"driver": "sqlite3", "poll_interval": "0s"},
+	} {
+		_, err := NewSqlClient(&libconfd.BackendConfig{
+			Type:    SqlBackendType,
+			Host:    []string{"file::memory:"},
+			Options: options,
+		})
+		if err == nil {
+			t.Fatalf("expect error: %v", options)
+		}
+	}
+}
+
+func TestSqlClient_WatchPrefix(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"poll_interval": "50ms", "version_column": "version"},
+		{"poll_interval": "50ms"},
+	} {
+		db := tNewSqliteDB(t)
+		db.Set(t, "/a", "1")
+		db.Set(t, "/b", "1")
+
+		c := tNewSqlClient(t, db.dsn, options)
+
+		stopChan := make(chan bool)
+		keys := []string{"/a"}
+
+		index, err := c.WatchPrefix("/", keys, 0, stopChan)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		watch := func(waitIndex uint64) chan uint64 {
+			ch := make(chan uint64, 1)
+			go func() {
+				index, err := c.WatchPrefix("/", keys, waitIndex, stopChan)
+				if err != nil {
+					t.Error(err)
+				}
+				ch <- index
+			}()
+			return ch
+		}
+		expectChanged := func(ch chan uint64) {
+			t.Helper()
+			select {
+			case newIndex := <-ch:
+				if newIndex <= index {
+					t.Fatalf("%v: index = %d, last = %d", options, newIndex, index)
+				}
+				index = newIndex
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v: timeout", options)
+			}
+		}
+
+		// other key
+		ch := watch(index)
+		db.Set(t, "/b", "2")
+		select {
+		case newIndex := <-ch:
+			t.Fatalf("%v: unexpected return: %d", options, newIndex)
+		case <-time.After(time.Second / 2):
+		}
+
+		db.Set(t, "/a", "2")
+		expectChanged(ch)
+
+		// changed between calls
+		db.Exec(t, `DELETE FROM libconfd WHERE name = '/a'`)
+		time.Sleep(time.Second / 10)
+		expectChanged(watch(index))
+
+		// stop
+		ch = watch(index)
+		close(stopChan)
+		select {
+		case newIndex := <-ch:
+			if newIndex != index {
+				t.Fatalf("%v: index = %d, expect = %d", options, newIndex, index)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: WatchPrefix is not stopped", options)
+		}
+
+		c.Close()
+		db.Close()
+	}
+}
+
+func TestSqlClient_WatchPrefix_sharedKeys(t *testing.T) {
+	db := tNewSqliteDB(t)
+	defer db.Close()
+	db.Set(t, "/a", "1")
+
+	c := tNewSqlClient(t, db.dsn, map[string]string{"poll_interval": "50ms"})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	keys := []string{"/a"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first watch sees the change, the second one polls later
+	db.Set(t, "/a", "2")
+	newIndex, err := c.WatchPrefix("/", keys, index, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newIndex <= index {
+		t.Fatalf("index = %d, last = %d", newIndex, index)
+	}
+
+	ch := make(chan uint64, 1)
+	go func() {
+		newIndex, err := c.WatchPrefix("/", keys, index, stopChan)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- newIndex
+	}()
+	select {
+	case index2 := <-ch:
+		if index2 != newIndex {
+			t.Fatalf("index = %d, expect = %d", index2, newIndex)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout: change missed")
+	}
+}
@@ -124,6 +124,11 @@ func (p TemplateFunc) Getvs(pattern string) []string {
 	return v
 }
 
+// Revision returns the backend revision of the values, 0 if unknown.
+func (p TemplateFunc) Revision() uint64 {
+	return p.Store.Revision()
+}
+
 // ----------------------------------------------------------------------------
 // Crypt func
 // ----------------------------------------------------------------------------
@@ -48,6 +48,7 @@ func init() {
 			"parseBool":      p.ParseBool,
 			"replace":        p.Replace,
 			"reverse":        p.Reverse,
+			"revision":       p.Revision,
 			"seq":            p.Seq,
 			"sortByLength":   p.SortByLength,
 			"sortKVByLength": p.SortKVByLength,
@@ -0,0 +1,727 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+var (
+	_ libconfd.BackendClient   = (*VaultClient)(nil)
+	_ libconfd.BackendClientV2 = (*VaultClient)(nil)
+)
+
+const VaultBackendType = "libconfd-backend-vault"
+
+func init() {
+	libconfd.RegisterBackendClient(
+		VaultBackendType,
+		func(cfg *libconfd.BackendConfig) (libconfd.BackendClient, error) {
+			return NewVaultClient(cfg)
+		},
+	)
+}
+
+var errNotFound = errors.New("backend_vault: not found")
+
+// VaultClient reads KV v1/v2 secrets from Vault.
+//
+// Each field of a secret is a key, so field password of secret
+// app/db is the key /app/db/password.
+//
+// WatchPrefix polls the secrets, and returns when a secret is changed.
+// Before the lease of a secret expires, the lease is renewed if it has a
+// renewable lease id, otherwise the secret is read again and WatchPrefix
+// returns, so the templates are rendered with the new lease. The token of
+// AppRole auth is renewed before it expires, and logged in again on failure.
+//
+// Supported BackendConfig fields:
+//
+//	host = ["https://127.0.0.1:8200"]       # tried in order
+//	user = ""                               # AppRole role_id
+//	password = ""                           # token, or AppRole secret_id
+//	client_ca_keys/client_cert/client_key   # enable https
+//
+//	[options]
+//	auth_method = "token"                   # token/approle
+//	approle_mount = "approle"
+//	mount = "secret"                        # KV secrets engine path
+//	kv_version = "2"                        # 1/2
+//	poll_interval = "30s"
+//	lease_renew_before = "1m"               # renew or read again before lease expired
+type VaultClient struct {
+	urls       []string
+	httpClient *http.Client
+
+	authMethod   string
+	approleMount string
+	roleID       string
+	secretID     string
+
+	mount            string
+	kvVersion        string
+	pollInterval     time.Duration
+	leaseRenewBefore time.Duration
+
+	mu          sync.Mutex
+	current     int
+	token       string
+	tokenExpire time.Time // zero if never expire
+	tokenTTL    time.Duration
+	renewable   bool
+
+	// lease of secret paths, updated by every read
+	leases map[string]vaultLease
+
+	// the values hash at each returned index of each watch,
+	// see vaultMaxWatchStates.
+	watchMu   sync.Mutex
+	index     uint64
+	snapshots map[string]map[uint64][32]byte // watched keys => index => hash
+
+	hookKeyAdjuster func(key string) (realKey string)
+}
+
+// the max saved hashes of each watch, the watches from an older index
+// return at once, since the values at the index are unknown.
+const vaultMaxWatchStates = 32
+
+type vaultLease struct {
+	id        string // empty if the lease can not be renewed by id
+	renewable bool
+	expire    time.Time
+	duration  time.Duration
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int64           `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *vaultAuth      `json:"auth"`
+	Errors        []string        `json:"errors"`
+}
+
+func NewVaultClient(cfg *libconfd.BackendConfig) (*VaultClient, error) {
+	if len(cfg.Host) == 0 {
+		return nil, fmt.Errorf("backend_vault: empty host")
+	}
+
+	pollInterval, err := cfg.GetDurationOption("poll_interval", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	leaseRenewBefore, err := cfg.GetDurationOption("lease_renew_before", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
+	var urls []string
+	for _, host := range cfg.Host {
+		if !strings.Contains(host, "://") {
+			host = scheme + "://" + host
+		}
+		urls = append(urls, strings.TrimSuffix(host, "/"))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	p := &VaultClient{
+		urls:       urls,
+		httpClient: &http.Client{Transport: transport, Timeout: time.Minute},
+
+		authMethod:   cfg.GetOption("auth_method", "token"),
+		approleMount: strings.Trim(cfg.GetOption("approle_mount", "approle"), "/"),
+
+		mount:            strings.Trim(cfg.GetOption("mount", "secret"), "/"),
+		kvVersion:        cfg.GetOption("kv_version", "2"),
+		pollInterval:     pollInterval,
+		leaseRenewBefore: leaseRenewBefore,
+
+		leases:    make(map[string]vaultLease),
+		index:     1,
+		snapshots: make(map[string]map[uint64][32]byte),
+
+		hookKeyAdjuster: cfg.HookKeyAdjuster,
+	}
+
+	switch p.authMethod {
+	case "token":
+		p.token = cfg.Password
+	case "approle":
+		p.roleID = cfg.UserName
+		p.secretID = cfg.Password
+	default:
+		return nil, fmt.Errorf("backend_vault: invalid auth_method %q", p.authMethod)
+	}
+
+	switch p.kvVersion {
+	case "1", "2":
+	default:
+		return nil, fmt.Errorf("backend_vault: invalid kv_version %q", p.kvVersion)
+	}
+
+	return p, nil
+}
+
+func (c *VaultClient) Type() string {
+	return VaultBackendType
+}
+
+func (c *VaultClient) WatchEnabled() bool {
+	return true
+}
+
+func (c *VaultClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// GetValues reads the secrets under keys.
+func (c *VaultClient) GetValues(keys []string) (map[string]string, error) {
+	return c.GetValuesContext(context.Background(), keys)
+}
+
+// GetValuesContext reads the secrets under keys.
+func (c *VaultClient) GetValuesContext(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		if c.hookKeyAdjuster != nil {
+			key = c.hookKeyAdjuster(key)
+		}
+		if err := c.walk(ctx, strings.Trim(key, "/"), vars, true); err != nil {
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+// walk reads the secret at secretPath and the secrets under it.
+// If nothing is found and isTop, secretPath may be a field of the parent secret.
+func (c *VaultClient) walk(ctx context.Context, secretPath string, vars map[string]string, isTop bool) error {
+	var found bool
+
+	if secretPath != "" {
+		fields, err := c.readSecret(ctx, secretPath)
+		switch {
+		case err == errNotFound:
+		case err != nil:
+			return err
+		default:
+			found = true
+			for k, v := range fields {
+				vars["/"+secretPath+"/"+k] = v
+			}
+		}
+	}
+
+	names, err := c.listSecrets(ctx, secretPath)
+	switch {
+	case err == errNotFound:
+	case err != nil:
+		return err
+	default:
+		found = true
+		for _, name := range names {
+			if err := c.walk(ctx, path.Join(secretPath, name), vars, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !found && isTop && strings.Contains(secretPath, "/") {
+		dir, field := path.Split(secretPath)
+		dir = strings.TrimSuffix(dir, "/")
+
+		fields, err := c.readSecret(ctx, dir)
+		switch {
+		case err == errNotFound:
+		case err != nil:
+			return err
+		default:
+			if v, ok := fields[field]; ok {
+				vars["/"+secretPath] = v
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *VaultClient) readSecret(ctx context.Context, secretPath string) (map[string]string, error) {
+	apiPath := c.mount + "/" + secretPath
+	if c.kvVersion == "2" {
+		apiPath = c.mount + "/data/" + secretPath
+	}
+
+	resp, err := c.request(ctx, "GET", apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if resp.LeaseDuration > 0 {
+		d := time.Duration(resp.LeaseDuration) * time.Second
+		c.leases[secretPath] = vaultLease{
+			id:        resp.LeaseID,
+			renewable: resp.Renewable,
+			expire:    time.Now().Add(d),
+			duration:  d,
+		}
+	} else {
+		delete(c.leases, secretPath)
+	}
+	c.mu.Unlock()
+
+	data := resp.Data
+	if c.kvVersion == "2" {
+		var v2 struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return nil, err
+		}
+		if len(v2.Data) == 0 || string(v2.Data) == "null" {
+			return nil, errNotFound // deleted version
+		}
+		data = v2.Data
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	for k, v := range fields {
+		if s, ok := v.(string); ok {
+			m[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = string(b)
+	}
+	return m, nil
+}
+
+func (c *VaultClient) listSecrets(ctx context.Context, secretPath string) ([]string, error) {
+	apiPath := c.mount + "/" + secretPath
+	if c.kvVersion == "2" {
+		apiPath = c.mount + "/metadata/" + secretPath
+	}
+
+	resp, err := c.request(ctx, "GET", strings.TrimSuffix(apiPath, "/")+"/?list=true", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Data, &list); err != nil {
+		return nil, err
+	}
+	return list.Keys, nil
+}
+
+// WatchPrefix polls the secrets under keys, and returns when any of them
+// is changed, or its lease is about to expire and can not be renewed.
+func (c *VaultClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	index, err := c.Watch(ctx, prefix, keys, waitIndex)
+	if err != nil && ctx.Err() != nil {
+		return index, nil // stopped
+	}
+	return index, err
+}
+
+// Watch is like WatchPrefix, it returns ctx.Err() when ctx is done.
+func (c *VaultClient) Watch(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	watchKey := strings.Join(keys, "\x00")
+
+	// return something > 0 to trigger a key retrieval from the store
+	if waitIndex == 0 {
+		sum, err := c.valuesHash(ctx, keys)
+		if err != nil {
+			return 1, err
+		}
+		return c.saveSnapshot(watchKey, 0, sum, false), nil
+	}
+
+	for {
+		delay := c.nextPollDelay(keys)
+		leaseExpiring := delay < c.pollInterval
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waitIndex, ctx.Err()
+		case <-timer.C:
+		}
+
+		if leaseExpiring && c.renewLeases(ctx, keys) {
+			leaseExpiring = false
+		}
+
+		sum, err := c.valuesHash(ctx, keys)
+		if err != nil {
+			if ctx.Err() != nil {
+				return waitIndex, ctx.Err()
+			}
+			return waitIndex, err
+		}
+
+		if index := c.saveSnapshot(watchKey, waitIndex, sum, leaseExpiring); index != waitIndex {
+			return index, nil
+		}
+	}
+}
+
+// saveSnapshot compares sum with the hash saved at waitIndex, and returns
+// the index of sum, it is waitIndex if not changed.
+//
+// The hashes are saved by the watch and the index, so each caller compares
+// with the values it has read, not the values of the last caller.
+func (c *VaultClient) saveSnapshot(watchKey string, waitIndex uint64, sum [32]byte, force bool) uint64 {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	states := c.snapshots[watchKey]
+	if states == nil {
+		states = make(map[uint64][32]byte)
+		c.snapshots[watchKey] = states
+	}
+
+	if last, ok := states[waitIndex]; ok && last == sum && !force {
+		return waitIndex
+	}
+
+	// reuse the current index if another caller has saved the same values
+	last, ok := states[c.index]
+	switch {
+	case ok && last == sum && c.index != waitIndex:
+		return c.index
+	case !ok && waitIndex == 0:
+	default:
+		c.index++
+	}
+	states[c.index] = sum
+
+	for len(states) > vaultMaxWatchStates {
+		oldest := c.index
+		for idx := range states {
+			if idx < oldest {
+				oldest = idx
+			}
+		}
+		delete(states, oldest)
+	}
+	return c.index
+}
+
+// valuesHash reads keys and returns the hash of the values.
+func (c *VaultClient) valuesHash(ctx context.Context, keys []string) ([32]byte, error) {
+	vars, err := c.GetValuesContext(ctx, keys)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&buf, "%q=%q\n", k, vars[k])
+	}
+	return sha256.Sum256(buf.Bytes()), nil
+}
+
+// nextPollDelay returns the delay before the next poll, it is shorter than
+// pollInterval if the lease of a secret under keys is about to expire.
+func (c *VaultClient) nextPollDelay(keys []string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delay := c.pollInterval
+	now := time.Now()
+
+	for _, lease := range c.watchedLeases(keys) {
+		d := c.renewTime(lease).Sub(now)
+		if d < time.Second {
+			// the lease may not be extended (max TTL reached)
+			d = time.Second
+		}
+		if d < delay {
+			delay = d
+		}
+	}
+
+	return delay
+}
+
+// renewLeases renews the leases of the secrets under keys which are about
+// to expire, and reports whether all of them are renewed. The leases without
+// a renewable lease id are not renewed, the secrets are read again instead.
+func (c *VaultClient) renewLeases(ctx context.Context, keys []string) bool {
+	c.mu.Lock()
+	now := time.Now()
+	expiring := make(map[string]vaultLease)
+	for secretPath, lease := range c.watchedLeases(keys) {
+		if !c.renewTime(lease).After(now) {
+			expiring[secretPath] = lease
+		}
+	}
+	c.mu.Unlock()
+
+	renewed := true
+	for secretPath, lease := range expiring {
+		if lease.id == "" || !lease.renewable {
+			renewed = false
+			continue
+		}
+
+		resp, err := c.request(ctx, "PUT", "sys/leases/renew", map[string]interface{}{
+			"lease_id":  lease.id,
+			"increment": int64(lease.duration / time.Second),
+		})
+		if err != nil || resp.LeaseDuration <= 0 {
+			if err != nil && ctx.Err() == nil {
+				libconfd.GetLogger().Warningf("backend_vault: renew lease of %s failed, read again: %v", secretPath, err)
+			}
+			renewed = false
+			continue
+		}
+
+		d := time.Duration(resp.LeaseDuration) * time.Second
+		c.mu.Lock()
+		c.leases[secretPath] = vaultLease{
+			id:        lease.id,
+			renewable: resp.Renewable,
+			expire:    time.Now().Add(d),
+			duration:  d,
+		}
+		c.mu.Unlock()
+	}
+	return renewed
+}
+
+// watchedLeases returns the leases of the secrets under keys.
+// The caller must hold c.mu.
+func (c *VaultClient) watchedLeases(keys []string) map[string]vaultLease {
+	leases := make(map[string]vaultLease)
+	for secretPath, lease := range c.leases {
+		for _, key := range keys {
+			if c.hookKeyAdjuster != nil {
+				key = c.hookKeyAdjuster(key)
+			}
+			key = strings.Trim(key, "/")
+			if key == "" || secretPath == key ||
+				strings.HasPrefix(secretPath, key+"/") ||
+				strings.HasPrefix(key, secretPath+"/") {
+				leases[secretPath] = lease
+				break
+			}
+		}
+	}
+	return leases
+}
+
+// renewTime returns the time to renew or read lease again, which is
+// lease_renew_before, but at most 1/3 of the lease duration, before it
+// expires.
+func (c *VaultClient) renewTime(lease vaultLease) time.Time {
+	before := c.leaseRenewBefore
+	if before > lease.duration/3 {
+		before = lease.duration / 3
+	}
+	return lease.expire.Add(-before)
+}
+
+// request sends the request to current Vault server, the token is
+// renewed or logged in again if needed.
+func (c *VaultClient) request(ctx context.Context, method, apiPath string, body interface{}) (*vaultResponse, error) {
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.doRequest(ctx, method, apiPath, token, body)
+}
+
+func (c *VaultClient) doRequest(ctx context.Context, method, apiPath, token string, body interface{}) (*vaultResponse, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	baseURL := c.getURL()
+
+	req, err := http.NewRequest(method, baseURL+"/v1/"+apiPath, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.nextURL(baseURL, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result vaultResponse
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("backend_vault: %s %s: %s", method, apiPath, resp.Status)
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && len(result.Errors) == 0:
+		return nil, errNotFound
+	case resp.StatusCode >= 400:
+		return nil, fmt.Errorf("backend_vault: %s %s: %s: %s",
+			method, apiPath, resp.Status, strings.Join(result.Errors, "; "),
+		)
+	}
+
+	return &result, nil
+}
+
+// getToken returns the token, the AppRole token is renewed when 2/3
+// of its TTL is passed, and logged in again if renewal failed.
+func (c *VaultClient) getToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token, expire, ttl, renewable := c.token, c.tokenExpire, c.tokenTTL, c.renewable
+	c.mu.Unlock()
+
+	if c.authMethod != "approle" {
+		return token, nil
+	}
+
+	if token != "" && (expire.IsZero() || time.Until(expire) > ttl/3) {
+		return token, nil
+	}
+
+	if token != "" && renewable && time.Now().Before(expire) {
+		resp, err := c.doRequest(ctx, "POST", "auth/token/renew-self", token, nil)
+		if err == nil && resp.Auth != nil {
+			return c.setToken(resp.Auth), nil
+		}
+		libconfd.GetLogger().Warningf("backend_vault: renew token failed, login again: %v", err)
+	}
+
+	resp, err := c.doRequest(ctx, "POST", "auth/"+c.approleMount+"/login", "", map[string]string{
+		"role_id":   c.roleID,
+		"secret_id": c.secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("backend_vault: login response has no token")
+	}
+	return c.setToken(resp.Auth), nil
+}
+
+func (c *VaultClient) setToken(auth *vaultAuth) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if auth.ClientToken != "" {
+		c.token = auth.ClientToken
+	}
+	c.renewable = auth.Renewable
+	c.tokenTTL = time.Duration(auth.LeaseDuration) * time.Second
+	if c.tokenTTL > 0 {
+		c.tokenExpire = time.Now().Add(c.tokenTTL)
+	} else {
+		c.tokenExpire = time.Time{}
+	}
+	return c.token
+}
+
+func (c *VaultClient) getURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.urls[c.current]
+}
+
+// nextURL switches to the next server if current server is still baseURL.
+func (c *VaultClient) nextURL(baseURL string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.urls[c.current] != baseURL || len(c.urls) == 1 {
+		return
+	}
+
+	libconfd.GetLogger().Warningf("backend_vault: %s failed: %v", baseURL, err)
+	c.current = (c.current + 1) % len(c.urls)
+}
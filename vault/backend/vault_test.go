@@ -0,0 +1,512 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backend_vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"openpitrix.io/libconfd"
+)
+
+// tFakeVault emulates a KV secrets engine mounted at secret/,
+// and the AppRole login and token renewal endpoints.
+type tFakeVault struct {
+	kvVersion string
+	roleID    string
+	secretID  string
+	tokenTTL  int64
+	leaseTTL  int64 // lease_duration of secrets
+	leaseIDs  bool  // secrets have renewable lease ids
+
+	mu      sync.Mutex
+	tokens  map[string]bool
+	secrets map[string]map[string]interface{}
+	logins  int
+	renews  int
+
+	leaseRenews int
+}
+
+func tNewFakeVault(kvVersion, rootToken string) *tFakeVault {
+	return &tFakeVault{
+		kvVersion: kvVersion,
+		tokens:    map[string]bool{rootToken: true},
+		secrets:   make(map[string]map[string]interface{}),
+	}
+}
+
+func (p *tFakeVault) Put(secretPath string, data map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.secrets[secretPath] = data
+}
+
+func (p *tFakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reply := func(v interface{}) {
+		json.NewEncoder(w).Encode(v)
+	}
+	replyError := func(code int, msg string) {
+		w.WriteHeader(code)
+		reply(map[string]interface{}{"errors": []string{msg}})
+	}
+
+	apiPath := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	if apiPath == "auth/approle/login" {
+		var req struct {
+			RoleID   string `json:"role_id"`
+			SecretID string `json:"secret_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.RoleID != p.roleID || req.SecretID != p.secretID {
+			replyError(http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		p.logins++
+		token := fmt.Sprintf("approle-token-%d", p.logins)
+		p.tokens[token] = true
+		reply(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": token, "lease_duration": p.tokenTTL, "renewable": true,
+		}})
+		return
+	}
+
+	token := r.Header.Get("X-Vault-Token")
+	if !p.tokens[token] {
+		replyError(http.StatusForbidden, "permission denied")
+		return
+	}
+
+	if apiPath == "auth/token/renew-self" {
+		p.renews++
+		reply(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": token, "lease_duration": p.tokenTTL, "renewable": true,
+		}})
+		return
+	}
+
+	if apiPath == "sys/leases/renew" && r.Method == "PUT" {
+		var req struct {
+			LeaseID string `json:"lease_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !p.leaseIDs || !strings.HasPrefix(req.LeaseID, "secret/") {
+			replyError(http.StatusBadRequest, "invalid lease ID")
+			return
+		}
+		p.leaseRenews++
+		reply(map[string]interface{}{
+			"lease_id": req.LeaseID, "lease_duration": p.leaseTTL, "renewable": true,
+		})
+		return
+	}
+
+	if !strings.HasPrefix(apiPath, "secret/") || r.Method != "GET" {
+		replyError(http.StatusNotFound, "no handler for route")
+		return
+	}
+	apiPath = strings.TrimPrefix(apiPath, "secret/")
+
+	if r.URL.Query().Get("list") == "true" {
+		if p.kvVersion == "2" {
+			apiPath = strings.TrimPrefix(apiPath, "metadata/")
+		}
+		dir := strings.Trim(apiPath, "/")
+		if dir != "" {
+			dir += "/"
+		}
+
+		seen := make(map[string]bool)
+		var keys []string
+		for k := range p.secrets {
+			if !strings.HasPrefix(k, dir) {
+				continue
+			}
+			name := strings.TrimPrefix(k, dir)
+			if i := strings.Index(name, "/"); i >= 0 {
+				name = name[:i+1]
+			}
+			if !seen[name] {
+				seen[name] = true
+				keys = append(keys, name)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			reply(map[string]interface{}{"errors": []string{}})
+			return
+		}
+		reply(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+		return
+	}
+
+	if p.kvVersion == "2" {
+		apiPath = strings.TrimPrefix(apiPath, "data/")
+	}
+	data, ok := p.secrets[apiPath]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		reply(map[string]interface{}{"errors": []string{}})
+		return
+	}
+
+	if p.kvVersion == "2" {
+		reply(map[string]interface{}{"data": map[string]interface{}{
+			"data": data, "metadata": map[string]interface{}{"version": 1},
+		}})
+		return
+	}
+	if p.leaseIDs {
+		reply(map[string]interface{}{
+			"lease_id": "secret/" + apiPath, "lease_duration": p.leaseTTL, "renewable": true, "data": data,
+		})
+		return
+	}
+	reply(map[string]interface{}{"lease_duration": p.leaseTTL, "data": data})
+}
+
+func TestVaultClient_GetValues(t *testing.T) {
+	vault := tNewFakeVault("2", "root")
+	vault.Put("app/db", map[string]interface{}{"user": "admin", "password": "123456"})
+	vault.Put("app/cache/redis", map[string]interface{}{"port": 6379})
+	vault.Put("appx", map[string]interface{}{"skip": "skip"})
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{server.URL},
+		Password: "root",
+	})
+	defer c.Close()
+
+	m, err := c.GetValues([]string{"/app", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"/app/db/user":          "admin",
+		"/app/db/password":      "123456",
+		"/app/cache/redis/port": "6379",
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m)
+	}
+
+	// field of secret
+	m, err = c.GetValues([]string{"/app/db/password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, map[string]string{"/app/db/password": "123456"}) {
+		t.Fatal(m)
+	}
+
+	// bad token
+	c = libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{server.URL},
+		Password: "bad",
+	})
+	defer c.Close()
+
+	if _, err := c.GetValues([]string{"/app"}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestVaultClient_approle(t *testing.T) {
+	vault := tNewFakeVault("1", "")
+	vault.roleID = "role"
+	vault.secretID = "secret"
+	vault.tokenTTL = 3
+	vault.Put("app/db", map[string]interface{}{"password": "123456"})
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{strings.TrimPrefix(server.URL, "http://")},
+		UserName: "role",
+		Password: "secret",
+		Options: map[string]string{
+			"auth_method": "approle",
+			"kv_version":  "1",
+		},
+	})
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		m, err := c.GetValues([]string{"/app/db"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m["/app/db/password"] != "123456" {
+			t.Fatal(m)
+		}
+		if i == 0 {
+			time.Sleep(2100 * time.Millisecond) // 2/3 of token TTL
+		}
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	if vault.logins != 1 || vault.renews == 0 {
+		t.Fatalf("logins = %d, renews = %d", vault.logins, vault.renews)
+	}
+}
+
+func TestVaultClient_WatchPrefix(t *testing.T) {
+	vault := tNewFakeVault("2", "root")
+	vault.Put("app/db", map[string]interface{}{"password": "123456"})
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{server.URL},
+		Password: "root",
+		Options:  map[string]string{"poll_interval": "100ms"},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	keys := []string{"/app/db"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(waitIndex uint64) chan uint64 {
+		ch := make(chan uint64, 1)
+		go func() {
+			index, err := c.WatchPrefix("/", keys, waitIndex, stopChan)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- index
+		}()
+		return ch
+	}
+	expectWakeup := func(ch chan uint64) {
+		t.Helper()
+		select {
+		case newIndex := <-ch:
+			if newIndex <= index {
+				t.Fatalf("index = %d, last = %d", newIndex, index)
+			}
+			index = newIndex
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// other secret
+	ch := watch(index)
+	vault.Put("app/cache", map[string]interface{}{"port": "6379"})
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(time.Second / 2):
+	}
+
+	// rotated
+	vault.Put("app/db", map[string]interface{}{"password": "abcdef"})
+	expectWakeup(ch)
+
+	// stop
+	ch = watch(index)
+	close(stopChan)
+	select {
+	case newIndex := <-ch:
+		if newIndex != index {
+			t.Fatalf("index = %d, last = %d", newIndex, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestVaultClient_leaseExpiring(t *testing.T) {
+	vault := tNewFakeVault("1", "root")
+	vault.leaseTTL = 3
+	vault.Put("app/db", map[string]interface{}{"password": "123456"})
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{server.URL},
+		Password: "root",
+		Options: map[string]string{
+			"kv_version":    "1",
+			"poll_interval": "1h",
+		},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	keys := []string{"/app/db/password"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// returns 1s before the lease is expired
+	start := time.Now()
+	newIndex, err := c.WatchPrefix("/", keys, index, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newIndex <= index {
+		t.Fatalf("index = %d, last = %d", newIndex, index)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Fatalf("returned after %v", d)
+	}
+}
+
+func TestVaultClient_WatchPrefix_sharedKeys(t *testing.T) {
+	vault := tNewFakeVault("2", "root")
+	vault.Put("app/db", map[string]interface{}{"password": "123456"})
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{server.URL},
+		Password: "root",
+		Options:  map[string]string{"poll_interval": "100ms"},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	keys := []string{"/app/db"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another template starts after the secret is rotated
+	vault.Put("app/db", map[string]interface{}{"password": "abcdef"})
+	index2, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index2 == index {
+		t.Fatalf("index = %d, expect a new index", index2)
+	}
+
+	// the first template still sees the rotation
+	ch := make(chan uint64, 1)
+	go func() {
+		newIndex, err := c.WatchPrefix("/", keys, index, stopChan)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- newIndex
+	}()
+	select {
+	case newIndex := <-ch:
+		if newIndex != index2 {
+			t.Fatalf("index = %d, expect %d", newIndex, index2)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout: change missed")
+	}
+
+	// the second template waits for the next change
+	ch = make(chan uint64, 1)
+	go func() {
+		newIndex, err := c.WatchPrefix("/", keys, index2, stopChan)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- newIndex
+	}()
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(time.Second / 2):
+	}
+}
+
+func TestVaultClient_leaseRenew(t *testing.T) {
+	vault := tNewFakeVault("1", "root")
+	vault.leaseTTL = 3
+	vault.leaseIDs = true
+	vault.Put("app/db", map[string]interface{}{"password": "123456"})
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	c := libconfd.MustNewBackendClient(&libconfd.BackendConfig{
+		Type:     VaultBackendType,
+		Host:     []string{server.URL},
+		Password: "root",
+		Options: map[string]string{
+			"kv_version":    "1",
+			"poll_interval": "1h",
+		},
+	})
+	defer c.Close()
+
+	stopChan := make(chan bool)
+	keys := []string{"/app/db/password"}
+
+	index, err := c.WatchPrefix("/", keys, 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the renewed lease does not wake up the watch
+	ch := make(chan uint64, 1)
+	go func() {
+		newIndex, err := c.WatchPrefix("/", keys, index, stopChan)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- newIndex
+	}()
+	select {
+	case newIndex := <-ch:
+		t.Fatalf("unexpected return: %d", newIndex)
+	case <-time.After(3 * time.Second):
+	}
+	close(stopChan)
+	<-ch
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	if vault.leaseRenews == 0 {
+		t.Fatal("lease is not renewed")
+	}
+}